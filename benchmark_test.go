@@ -0,0 +1,235 @@
+package cbheartbeat_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+	"github.com/tleyden/cb-heartbeat/cbheartbeattest"
+)
+
+// How long each simulated round trip to Couchbase takes
+const benchmarkRoundTrip = 100 * time.Microsecond
+
+// A MemoryStore which takes benchmarkRoundTrip for every operation, and
+// counts the round trips and the bytes of the docs written
+type slowStore struct {
+	*cbheartbeattest.MemoryStore
+	roundTrips   int64
+	bytesWritten int64
+}
+
+func (s *slowStore) roundTrip() {
+	atomic.AddInt64(&s.roundTrips, 1)
+	time.Sleep(benchmarkRoundTrip)
+}
+
+func (s *slowStore) written(doc interface{}) {
+	value, _ := json.Marshal(doc)
+	atomic.AddInt64(&s.bytesWritten, int64(len(value)))
+}
+
+func (s *slowStore) Upsert(docId string, doc interface{}, ttl time.Duration) error {
+	s.roundTrip()
+	s.written(doc)
+	return s.MemoryStore.Upsert(docId, doc, ttl)
+}
+
+func (s *slowStore) Insert(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+	s.roundTrip()
+	s.written(doc)
+	return s.MemoryStore.Insert(docId, doc, ttl)
+}
+
+func (s *slowStore) Get(docId string, doc interface{}) error {
+	s.roundTrip()
+	return s.MemoryStore.Get(docId, doc)
+}
+
+func (s *slowStore) Delete(docId string) error {
+	s.roundTrip()
+	return s.MemoryStore.Delete(docId)
+}
+
+func (s *slowStore) Touch(docId string, ttl time.Duration) error {
+	s.roundTrip()
+	return s.MemoryStore.Touch(docId, ttl)
+}
+
+func (s *slowStore) QueryHeartbeatDocs(heartbeatDocType, docIdPrefix string) ([]json.RawMessage, error) {
+	s.roundTrip()
+	return s.MemoryStore.QueryHeartbeatDocs(heartbeatDocType, docIdPrefix)
+}
+
+// A slowStore which can also read or write many docs in one round trip
+type slowBulkStore struct {
+	*slowStore
+}
+
+func (s slowBulkStore) GetBulk(docIds []string) (map[string]json.RawMessage, error) {
+	s.roundTrip()
+	docs := map[string]json.RawMessage{}
+	for _, docId := range docIds {
+		doc := json.RawMessage{}
+		err := s.MemoryStore.Get(docId, &doc)
+		if err == cbheartbeat.ErrDocNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs[docId] = doc
+	}
+	return docs, nil
+}
+
+func (s slowBulkStore) UpsertBulk(writes []cbheartbeat.BulkWrite) []error {
+	s.roundTrip()
+	errs := make([]error, len(writes))
+	for i, write := range writes {
+		s.written(write.Doc)
+		errs[i] = s.MemoryStore.Upsert(write.DocId, write.Doc, write.TTL)
+	}
+	return errs
+}
+
+// Start the given number of nodes, each of which has sent one heartbeat
+func startNodes(b *testing.B, c *cluster, nodes int, interval time.Duration) []cbheartbeat.Heartbeater {
+	b.Helper()
+	heartbeaters := make([]cbheartbeat.Heartbeater, nodes)
+	for i := range heartbeaters {
+		heartbeaters[i] = c.heartbeater(fmt.Sprintf("node-%04d", i))
+		sendOnce(b, heartbeaters[i], interval)
+	}
+	return heartbeaters
+}
+
+func reportRoundTrips(b *testing.B, store *slowStore, per string) {
+	b.ReportMetric(float64(atomic.LoadInt64(&store.roundTrips))/float64(b.N), "roundtrips/"+per)
+}
+
+// Checking 100 or more nodes, looking up each one's timeout doc on its own
+// or all of them with one bulk get
+func BenchmarkCheck(b *testing.B) {
+	for _, nodes := range []int{100, 500} {
+		for _, bulk := range []bool{false, true} {
+			name := fmt.Sprintf("nodes=%v/sequential", nodes)
+			if bulk {
+				name = fmt.Sprintf("nodes=%v/bulk", nodes)
+			}
+			b.Run(name, func(b *testing.B) {
+
+				c := newCluster(b)
+				startNodes(b, c, nodes, time.Hour)
+				slow := &slowStore{MemoryStore: c.store}
+				var store cbheartbeat.Store = slow
+				if bulk {
+					store = slowBulkStore{slow}
+				}
+				checker := c.heartbeaterWithStore(store, "checker")
+				startChecker(b, checker, nil)
+
+				atomic.StoreInt64(&slow.roundTrips, 0)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if result := runCheck(b, checker); result.LiveNodes != nodes {
+						b.Fatalf("%v live nodes, want %v", result.LiveNodes, nodes)
+					}
+				}
+				b.StopTimer()
+				reportRoundTrips(b, slow, "check")
+
+			})
+		}
+	}
+}
+
+// Handling 500 nodes which have all gone stale, on one worker or several
+func BenchmarkCheckWorkers(b *testing.B) {
+	const nodes = 500
+	for _, workers := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("nodes=%v/workers=%v", nodes, workers), func(b *testing.B) {
+
+			c := newCluster(b)
+			heartbeaters := startNodes(b, c, nodes, time.Second)
+			slow := &slowStore{MemoryStore: c.store}
+			checker := c.heartbeaterWithStore(slowBulkStore{slow}, "checker", cbheartbeat.WithCheckWorkers(workers))
+			startChecker(b, checker, nil)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if i > 0 {
+					for _, heartbeater := range heartbeaters {
+						sendOnce(b, heartbeater, time.Second)
+					}
+				}
+				c.clock.Advance(2 * time.Second)
+				b.StartTimer()
+				if result := runCheck(b, checker); result.StaleNodes != nodes {
+					b.Fatalf("%v stale nodes, want %v", result.StaleNodes, nodes)
+				}
+			}
+
+		})
+	}
+}
+
+// Writing a heartbeat, ie the heartbeat doc and timeout doc, one after the
+// other as the default store does, or together as a store with a real
+// multi-op does, eg cbgocb's
+func BenchmarkSend(b *testing.B) {
+	for _, bulk := range []bool{false, true} {
+		name := "separate"
+		if bulk {
+			name = "bulk"
+		}
+		b.Run(name, func(b *testing.B) {
+
+			c := newCluster(b)
+			slow := &slowStore{MemoryStore: c.store}
+			var store cbheartbeat.Store = slow
+			if bulk {
+				store = slowBulkStore{slow}
+			}
+			h := c.heartbeaterWithStore(store, "a")
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sendOnce(b, h, time.Second)
+			}
+			b.StopTimer()
+			reportRoundTrips(b, slow, "beat")
+
+		})
+	}
+}
+
+// The bytes of docs written per heartbeat, with and without WithMinimalWrites
+func BenchmarkSendMinimalWrites(b *testing.B) {
+	for _, minimal := range []bool{false, true} {
+		b.Run(fmt.Sprintf("minimal=%v", minimal), func(b *testing.B) {
+
+			c := newCluster(b)
+			slow := &slowStore{MemoryStore: c.store}
+			h := c.heartbeaterWithStore(slow, "a",
+				cbheartbeat.WithMetadata(map[string]string{"host": "a.example.com", "version": "1.2.3"}),
+				cbheartbeat.WithMinimalWrites(minimal))
+			sendOnce(b, h, time.Second)
+
+			atomic.StoreInt64(&slow.roundTrips, 0)
+			atomic.StoreInt64(&slow.bytesWritten, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sendOnce(b, h, time.Second)
+			}
+			b.StopTimer()
+			reportRoundTrips(b, slow, "beat")
+			b.ReportMetric(float64(atomic.LoadInt64(&slow.bytesWritten))/float64(b.N), "bytes/beat")
+
+		})
+	}
+}
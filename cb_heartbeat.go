@@ -1,17 +1,68 @@
 package cbheartbeat
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/couchbase/go-couchbase"
-	"github.com/couchbase/go-couchbase/util"
 )
 
 const (
 	docTypeHeartbeat        = "heartbeat"
 	docTypeHeartbeatTimeout = "heartbeat_timeout"
+	docTypeHeartbeatStale   = "heartbeat_stale"
+	docTypeHeartbeatLeader  = "heartbeat_leader"
+	defaultDesignDocName    = "cbgt"
+	defaultViewName         = "heartbeats"
+	defaultOperationTimeout = 30 * time.Second
+	defaultPoolName         = "default"
+
+	defaultStaleEventsBufferSize  = 100
+	defaultErrorsBufferSize       = 100
+	defaultTimeoutMultiplier      = 2
+	defaultReconnectInterval      = 5 * time.Second
+	defaultStaleAfterMissedChecks = 1
+	defaultHeartbeatDocTTL        = 24 * time.Hour
+
+	// the heartbeat doc always lives at least this many times as long as
+	// the heartbeat timeout doc, so that checkers see the timeout doc expire
+	// before the heartbeat doc does
+	minHeartbeatDocTTLMultiplier = 10
+
+	// for this long after the design doc is published, a view query which
+	// fails because the index isn't built yet is retried every
+	// defaultViewNotReadyRetryDelay, and then treated as finding no
+	// heartbeat docs
+	viewWarmupPeriod              = time.Minute
+	viewNotReadyRetries           = 3
+	defaultViewNotReadyRetryDelay = time.Second
+)
+
+// How up to date the heartbeat view index must be when it is queried.  See
+// the Couchbase Server documentation for the view "stale" parameter.
+type ViewStaleness string
+
+const (
+	// Update the index before every query.  Always accurate, but expensive
+	// on a busy bucket.  This is the default.
+	StaleFalse ViewStaleness = "false"
+
+	// Query the index as it is, without updating it
+	StaleOK ViewStaleness = "ok"
+
+	// Query the index as it is, and update it afterwards.  Usually fine since
+	// stale detection already tolerates a grace period, and much cheaper.
+	StaleUpdateAfter ViewStaleness = "update_after"
 )
 
 // A Heartbeater is something that can both send and check for heartbeats that
@@ -19,19 +70,74 @@ const (
 type Heartbeater interface {
 	HeartbeatChecker
 	HeartbeatSender
+	SetMetadata(metadata map[string]string)
+	Errors() <-chan error
+	Start(sendInterval, staleThreshold time.Duration, handler HeartbeatsStoppedHandler) error
+	Stop()
+	Wait()
+	Close() error
+	StartLeaderElection() (<-chan bool, error)
+	Config() HeartbeaterConfig
+	QueryHeartbeatView() ([]HeartbeatViewRow, error)
 }
 
 // A HeartbeatChecker checks _other_ nodes in the cluster for stale heartbeats
 // and reacts by calling back the HeartbeatsStoppedHandler
 type HeartbeatChecker interface {
 	StartCheckingHeartbeats(staleThresholdMs int, handler HeartbeatsStoppedHandler) error
+	StartCheckingHeartbeatsContext(ctx context.Context, staleThreshold time.Duration, handler HeartbeatsStoppedHandler) error
 	StopCheckingHeartbeats()
+	CheckNow() error
+	RunCheck() (CheckResult, error)
+	SetStaleHandler(handler HeartbeatsStoppedHandler)
+	AddStaleHandler(handler HeartbeatsStoppedHandler)
+	RemoveStaleHandler(handler HeartbeatsStoppedHandler)
+	LiveNodes() ([]string, error)
+	LiveNodesContext(ctx context.Context) ([]string, error)
+	IsNodeAlive(nodeUuid string) (bool, error)
+	IsNodeAliveContext(ctx context.Context, nodeUuid string) (bool, error)
+	NodeInfos() ([]NodeInfo, error)
+	NodeInfosContext(ctx context.Context) ([]NodeInfo, error)
+	AllHeartbeatRecords() ([]HeartbeatRecord, error)
+	StaleEvents() <-chan string
+	StaleNodes() []string
+	SetExcludedNodes(nodeUuids []string)
+	ReapStaleDocs() (int, error)
+	ClockSkew(nodeUuid string) time.Duration
+	Phi(nodeUuid string) float64
+	LastSequence(nodeUuid string) uint64
+	LastCheckAttempt() time.Time
 }
 
 // A HeartbeatSender sends heartbeats
 type HeartbeatSender interface {
 	StartSendingHeartbeats(intervalMs int) error
+	StartSendingHeartbeatsContext(ctx context.Context, interval time.Duration) error
+	SetSendInterval(interval time.Duration) error
 	StopSendingHeartbeats()
+	PauseSending()
+	ResumeSending()
+	Deregister() error
+	SenderHealth() (lastSuccess time.Time, lastErr error)
+	LastSendAttempt() time.Time
+}
+
+// Called back when this node's own heartbeats keep failing to be written, so
+// that other nodes will soon see it as stale, eg so that it can stop taking
+// traffic before another node takes over its work.  See WithSelfUnhealthyHandler.
+type SelfUnhealthyHandler interface {
+
+	// The last failures heartbeats in a row failed, the last one with err
+	SelfUnhealthy(failures int, err error)
+
+	// A heartbeat was written again after SelfUnhealthy was called
+	SelfRecovered()
+}
+
+// Handlers that also implement this interface will be called back when a
+// node that was previously reported as stale starts sending heartbeats again.
+type HeartbeatResumedHandler interface {
+	NodeRejoined(nodeUuid string)
 }
 
 // This is the callback interface that clients of this library
@@ -41,9 +147,133 @@ type HeartbeatsStoppedHandler interface {
 	StaleHeartBeatDetected(nodeUuid string)
 }
 
+// Handlers that also implement this interface will be called back with the
+// time the stale node last sent a heartbeat, instead of StaleHeartBeatDetected.
+// The lastSeen time will be the zero time if it is unknown, eg if the stale
+// node was running an older version of this library.
+type HeartbeatsStoppedLastSeenHandler interface {
+	HeartbeatsStoppedHandler
+	StaleHeartBeatDetectedLastSeen(nodeUuid string, lastSeen time.Time)
+}
+
+// Handlers that also implement this interface will be called back with a
+// StaleEvent, which includes the node's last metadata, instead of
+// StaleHeartBeatDetected or StaleHeartBeatDetectedLastSeen.
+type DetailedStaleHandler interface {
+	HeartbeatsStoppedHandler
+	StaleHeartBeatDetectedEvent(event StaleEvent)
+}
+
+// Handlers that also implement this interface are called back once with all
+// the nodes over the limit set by WithStaleHandlerLimit, when more nodes go
+// stale in one check than the limit allows, rather than having them queued
+// for later checks.
+type CoalescedStaleHandler interface {
+	HeartbeatsStoppedHandler
+	StaleHeartBeatsCoalesced(events []StaleEvent)
+}
+
+// Decides how long a node's heartbeat timeout doc must have been missing
+// before the node is stale, given how many checks in a row it has been
+// missing for, see WithStaleThresholdFunc.  Called from the checker
+// goroutine, once per missing node per check.
+type StaleThresholdFunc func(nodeUuid string, consecutiveMisses int) time.Duration
+
+// The details of a node being found stale, which marshal to JSON for logging
+type StaleEvent struct {
+	NodeUUID       string        `json:"node_uuid"`
+	LastSeen       time.Time     `json:"last_seen"`       // the node's last heartbeat, or the zero time if unknown
+	DetectedAt     time.Time     `json:"detected_at"`     // when the checker found it stale, by the checker's clock
+	StaleThreshold time.Duration `json:"stale_threshold"` // as passed to StartCheckingHeartbeatsContext
+	OverThreshold  time.Duration `json:"over_threshold"`  // how long past the threshold it was detected, zero if LastSeen is unknown
+
+	// as last set by the node with SetMetadata, eg its hostname and role,
+	// read from its heartbeat doc before the checker deleted it
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func newStaleEvent(heartbeatDoc heartbeatMeta, detectedAt time.Time, staleThreshold time.Duration) StaleEvent {
+	event := StaleEvent{
+		NodeUUID:       heartbeatDoc.NodeUUID,
+		LastSeen:       heartbeatDoc.LastSeen(),
+		DetectedAt:     detectedAt,
+		StaleThreshold: staleThreshold,
+		Metadata:       heartbeatDoc.Metadata,
+	}
+	if !event.LastSeen.IsZero() {
+		// clock skew between the nodes can make this negative
+		event.OverThreshold = detectedAt.Sub(event.LastSeen) - staleThreshold
+	}
+	return event
+}
+
+// What a single check for stale heartbeats found, see RunCheck
+type CheckResult struct {
+	HeartbeatDocs  int           // heartbeat docs seen, including this node's own
+	LiveNodes      int           // other nodes which are still alive
+	StaleNodes     int           // nodes found to be stale by this check
+	DeleteFailures int           // stale nodes whose heartbeat doc couldn't be deleted
+	Duration       time.Duration // how long the check took
+}
+
+// Returns the id of a doc of the given kind, for the given node, see
+// WithDocIdFunc.  The leader doc has no node, so its nodeUuid is empty, and
+// the design doc version marker is passed "<design doc>/<view>" instead.
+type DocIdFunc func(kind, nodeUuid string) string
+
+// The kinds of doc passed to a DocIdFunc
+const (
+	DocKindHeartbeat        = docTypeHeartbeat
+	DocKindHeartbeatTimeout = docTypeHeartbeatTimeout
+	DocKindHeartbeatStale   = docTypeHeartbeatStale
+	DocKindLeader           = docTypeHeartbeatLeader
+	DocKindDesignDocVersion = "ddocVersion"
+)
+
+// Information about a live node, as read from its heartbeat doc
+type NodeInfo struct {
+	NodeUUID string
+	LastSeen time.Time         // zero if unknown
+	Sequence uint64            // incremented with every heartbeat, zero if unknown
+	Timeout  time.Duration     // how long the node's heartbeat timeout doc lives, zero if unknown
+	Metadata map[string]string // as set by the node with SetMetadata
+}
+
+// A heartbeat doc as found by AllHeartbeatRecords, whether or not the node
+// is still alive
+type HeartbeatRecord struct {
+	NodeInfo
+	Alive         bool // the node's heartbeat timeout doc still exists
+	Self          bool // the heartbeat doc is this node's own
+	ReportedStale bool // this node's checker has reported the node stale
+}
+
 type heartbeatMeta struct {
-	Type     string `json:"type"`
-	NodeUUID string `json:"node_uuid"`
+	Type      string            `json:"type"`
+	NodeUUID  string            `json:"node_uuid"`
+	Timestamp int64             `json:"last_seen,omitempty"`  // unix millis, zero if unknown
+	Sequence  uint64            `json:"seq,omitempty"`        // incremented with every heartbeat, zero if unknown
+	TimeoutMs int64             `json:"timeout_ms,omitempty"` // ttl of the node's timeout doc, zero if unknown
+	Metadata  map[string]string `json:"metadata,omitempty"`   // arbitrary user data, see SetMetadata
+	Minimal   bool              `json:"minimal,omitempty"`    // only rewritten when it changes, so last_seen and seq don't advance, see WithMinimalWrites
+}
+
+// The time of the last heartbeat, or the zero time if unknown
+func (m heartbeatMeta) LastSeen() time.Time {
+	if m.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, m.Timestamp*int64(time.Millisecond))
+}
+
+func (m heartbeatMeta) nodeInfo() NodeInfo {
+	return NodeInfo{
+		NodeUUID: m.NodeUUID,
+		LastSeen: m.LastSeen(),
+		Sequence: m.Sequence,
+		Timeout:  time.Duration(m.TimeoutMs) * time.Millisecond,
+		Metadata: m.Metadata,
+	}
 }
 
 type heartbeatTimeout struct {
@@ -51,14 +281,109 @@ type heartbeatTimeout struct {
 	NodeUUID string `json:"node_uuid"`
 }
 
+// Marker doc claimed by whichever checker reports a stale node first, when
+// running with WithSingleNotifier
+type heartbeatStale struct {
+	Type       string `json:"type"`
+	NodeUUID   string `json:"node_uuid"`
+	ReportedBy string `json:"reported_by"`
+}
+
 type couchbaseHeartBeater struct {
-	bucket               *couchbase.Bucket
-	couchbaseUrlStr      string
-	bucketName           string
-	nodeUuid             string
-	keyPrefix            string
-	heartbeatSendCloser  chan struct{} // break out of heartbeat sender goroutine
-	heartbeatCheckCloser chan struct{} // break out of heartbeat checker goroutine
+	sequence               uint64 // of the last heartbeat sent, accessed atomically so must come first for alignment
+	lastSendAttempt        int64  // unix nanos, accessed atomically, see LastSendAttempt()
+	lastCheckAttempt       int64  // unix nanos, accessed atomically, see LastCheckAttempt()
+	store                  Store
+	couchbase              *couchbaseStore // configured by the couchbase-specific Options
+	nodeUuid               string
+	keyPrefix              string
+	heartbeatDocType       string // "type" field values of the docs, see WithDocTypePrefix
+	timeoutDocType         string
+	staleDocType           string
+	leaderDocType          string
+	logger                 Logger
+	metrics                MetricsRecorder
+	tracer                 Tracer
+	clock                  Clock
+	timeoutMultiplier      float64       // timeout doc expiry, as a multiple of the send interval
+	timeoutGracePeriod     time.Duration // added to the timeout doc expiry
+	heartbeatDocTTL        time.Duration // heartbeat doc expiry, 0 for never, see WithHeartbeatDocTTL
+	sendRetries            int           // retries for transient errors writing heartbeat docs
+	sendRetryDelay         time.Duration // delay before the first retry, doubled after each one
+	durability             Durability    // for heartbeat timeout doc writes
+	jitter                 float64       // fraction of the send interval to randomize each wait by
+	sendIntervalMutex      sync.Mutex    // guards sendInterval
+	sendInterval           time.Duration // may be changed while the sender is running
+	sendPaused             int32         // non-zero while paused, accessed atomically, see PauseSending()
+	metadataMutex          sync.Mutex    // guards metadata
+	metadata               map[string]string
+	heartbeatDocDirty      bool                     // metadata changed since the heartbeat doc was last written
+	heartbeatDocWritten    time.Time                // when the heartbeat doc was last written in full
+	heartbeatDocInterval   time.Duration            // the send interval when it was
+	minimalWrites          bool                     // see WithMinimalWrites
+	docIdFunc              DocIdFunc                // nil for the default doc ids, see WithDocIdFunc
+	docCodec               DocCodec                 // nil for the default JSON, see WithDocCodec
+	singleDoc              bool                     // no timeout docs, see WithSingleDoc
+	staleEvents            chan string              // node uuids of stale nodes, see StaleEvents()
+	staleEventsBufferSize  int                      // see WithStaleEventsBufferSize
+	errorsBufferSize       int                      // see WithErrorsBufferSize
+	errors                 chan error               // errors from the sender and checker goroutines, see Errors()
+	checkMutex             sync.Mutex               // serializes checks
+	checkConfigMutex       sync.Mutex               // guards checkStarted and checkStaleThreshold
+	checkStarted           bool                     // the checker has been started, see CheckNow()
+	checkStaleThreshold    time.Duration            // as passed to StartCheckingHeartbeats
+	staleNodesMutex        sync.Mutex               // guards staleNodes, which is read by StaleNodes()
+	staleNodes             map[string]struct{}      // nodes reported stale
+	missedChecks           map[string]int           // consecutive checks each node's timeout doc was missing, ditto
+	missedSince            map[string]time.Time     // when each node's timeout doc was first seen missing, ditto
+	singleDocNodes         map[string]heartbeatMeta // last heartbeat doc seen for each node, see WithSingleDoc
+	checkInterval          time.Duration            // how often to check, if less than the stale threshold
+	checkWorkers           int                      // goroutines handling stale nodes, see WithCheckWorkers
+	excludeMutex           sync.Mutex               // guards excludedNodes
+	excludedNodes          map[string]struct{}      // never reported stale, see SetExcludedNodes
+	excludeNodeFunc        func(nodeUuid string) bool
+	staleAfterMissedChecks int
+	staleThresholdFunc     StaleThresholdFunc         // see WithStaleThresholdFunc, nil for the threshold passed to Start
+	phiThreshold           float64                    // see WithPhiAccrual, 0 to disable
+	phiMutex               sync.Mutex                 // guards phiDetectors
+	phiDetectors           map[string]*phiDetector    // per node, see Phi()
+	staleHandlersMutex     sync.Mutex                 // guards checkHandler and staleHandlers
+	checkHandler           HeartbeatsStoppedHandler   // as passed to StartCheckingHeartbeats, or SetStaleHandler
+	staleHandlers          []HeartbeatsStoppedHandler // see AddStaleHandler, replaced rather than modified
+	asyncHandlers          bool                       // call handlers on their own goroutines, see WithAsyncHandlers
+	staleHandlerLimit      int                        // nodes notified per check, see WithStaleHandlerLimit, 0 for no limit
+	handlerBudgetMutex     sync.Mutex                 // guards handlerBudget, overflowStale and queuedStale
+	handlerBudget          int                        // nodes which can still be notified in this check
+	overflowStale          []StaleEvent               // over the limit in this check
+	queuedStale            []queuedStaleEvent         // over the limit in earlier checks, oldest first
+	clockSkewMutex         sync.Mutex                 // guards clockSkews
+	clockSkews             map[string]time.Duration   // per live node, as of the last check, see ClockSkew()
+	clockSkewWarning       time.Duration              // log a warning when skew exceeds this, 0 to disable
+	sequencesMutex         sync.Mutex                 // guards sequences
+	sequences              map[string]uint64          // per node, as of the last check, see LastSequence()
+	checkSequences         bool                       // treat nodes whose sequence stops advancing as stale
+	keepStaleDocs          bool                       // don't delete heartbeat docs of stale nodes, see WithKeepStaleDocs
+	readOnlyChecker        bool                       // the checker never writes to the store, see WithReadOnlyChecker
+	observer               bool                       // only checks, never sends, see WithObserver
+	singleNotifier         bool                       // only one checker in the cluster notifies per stale node
+	staleMarkerTTL         time.Duration              // see WithStaleMarkerTTL, 0 to derive it from the stale threshold
+	runMutex               sync.Mutex                 // guards heartbeatSendCloser and heartbeatCheckCloser
+	heartbeatSendCloser    chan struct{}              // break out of heartbeat sender goroutine, nil unless running
+	heartbeatCheckCloser   chan struct{}              // break out of heartbeat checker goroutine, nil unless running
+	closeOnce              sync.Once                  // guards against closing the store twice
+	closeErr               error                      // returned by every call to Close
+	deregisterOnClose      bool                       // see WithDeregisterOnClose
+	goroutines             sync.WaitGroup             // the sender, checker and async handler goroutines, see Wait()
+	senderHealthMutex      sync.Mutex                 // guards lastSendSuccess, lastSendErr, sendFailures and selfUnhealthy
+	lastSendSuccess        time.Time
+	lastSendErr            error
+	sendFailures           int                  // consecutive failed heartbeats
+	selfUnhealthy          bool                 // selfUnhealthyHandler has been told this node is unhealthy
+	selfUnhealthyAfter     int                  // consecutive failures before calling selfUnhealthyHandler
+	selfUnhealthyHandler   SelfUnhealthyHandler // see WithSelfUnhealthyHandler
+	leaderMutex            sync.Mutex           // guards leaderChanges and isLeader
+	leaderChanges          chan bool            // nil unless StartLeaderElection has been called
+	isLeader               bool
 }
 
 // Create a new CouchbaseHeartbeater, passing in the arguments needed to connect to Couchbase
@@ -67,73 +392,270 @@ type couchbaseHeartBeater struct {
 // library.  You can think of nodeUuid as a generic token, so put whatever you want there
 // as long as it is unique to the node where this is running.  (eg, an ip address could work)
 func NewCouchbaseHeartbeater(couchbaseUrl, bucketName, keyPrefix, nodeUuid string) (Heartbeater, error) {
+	return NewCouchbaseHeartbeaterWithOptions(
+		couchbaseUrl,
+		bucketName,
+		WithKeyPrefix(keyPrefix),
+		WithNodeUUID(nodeUuid),
+	)
+}
 
-	heartbeater := &couchbaseHeartBeater{
-		couchbaseUrlStr:      couchbaseUrl,
-		bucketName:           bucketName,
-		nodeUuid:             nodeUuid,
-		keyPrefix:            keyPrefix,
-		heartbeatSendCloser:  make(chan struct{}),
-		heartbeatCheckCloser: make(chan struct{}),
+// Create a new CouchbaseHeartbeater, passing in the arguments needed to connect to Couchbase
+// Server (url, bucket), and any number of Options.  At the very least WithNodeUUID should
+// be passed, see NewCouchbaseHeartbeater.  The heartbeat docs are kept in the bucket's
+// default collection, since go-couchbase can't address any other, and the map-reduce
+// view used to find them only indexes that one anyway.
+func NewCouchbaseHeartbeaterWithOptions(couchbaseUrl, bucketName string, opts ...Option) (Heartbeater, error) {
+
+	store := newCouchbaseStore(couchbaseUrl, bucketName)
+	heartbeater, err := newHeartbeater(store, store, opts)
+	if err != nil {
+		return nil, err
 	}
 
 	// get bucket or else return error
-	_, err := heartbeater.getBucket()
+	if err := store.connect(); err != nil {
+		return nil, err
+	}
+	return heartbeater, nil
+
+}
+
+// Create a Store for a Couchbase Server bucket, eg to pass to NewMultiStore
+// along with the Stores for other buckets.  Only the Options which configure
+// the connection, like WithCredentials, and WithKeyPrefix, WithDocIdFunc and
+// WithLogger apply, the rest should be passed to NewHeartbeaterWithStore.
+// Use the same key prefix and DocIdFunc for both.
+func NewCouchbaseStore(couchbaseUrl, bucketName string, opts ...Option) (Store, error) {
+
+	store := newCouchbaseStore(couchbaseUrl, bucketName)
+	heartbeater := &couchbaseHeartBeater{
+		couchbase: store,
+		logger:    stdLogger{},
+		metrics:   noopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(heartbeater)
+	}
+	store.keyPrefix = heartbeater.keyPrefix
+	store.docId = heartbeater.docId
+	store.logger = heartbeater.logger
+	store.metrics = heartbeater.metrics
+
+	if err := store.connect(); err != nil {
+		return nil, err
+	}
+	return store, nil
+
+}
+
+// Create a new CouchbaseHeartbeater which uses a bucket that the caller has
+// already connected to, rather than opening another connection to it.  The
+// bucket still belongs to the caller: Close won't close it, and if the
+// connection is lost the caller is responsible for reconnecting it.  See
+// NewCouchbaseHeartbeater for the other arguments.
+func NewCouchbaseHeartbeaterWithBucket(bucket *couchbase.Bucket, keyPrefix, nodeUuid string, opts ...Option) (Heartbeater, error) {
+
+	if bucket == nil {
+		return nil, fmt.Errorf("Invalid bucket: must not be nil")
+	}
+	store := newCouchbaseStore("", bucket.Name)
+	store.bucket = bucket
+	store.sharedBucket = true
+	opts = append([]Option{WithKeyPrefix(keyPrefix), WithNodeUUID(nodeUuid)}, opts...)
+	heartbeater, err := newHeartbeater(store, store, opts)
 	if err != nil {
 		return nil, err
 	}
+
 	return heartbeater, nil
 
 }
 
-// Kick off the heartbeat sender with the given interval, in milliseconds.
-func (h *couchbaseHeartBeater) StartSendingHeartbeats(intervalMs int) error {
+// Create a new Heartbeater which keeps its docs in the given Store, rather
+// than connecting to Couchbase Server itself.  Options which only apply to
+// the default go-couchbase store, like WithCredentials, are ignored.
+func NewHeartbeaterWithStore(store Store, opts ...Option) (Heartbeater, error) {
+	return newHeartbeater(store, newCouchbaseStore("", ""), opts)
+}
 
-	ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+func newHeartbeater(store Store, couchbaseStore *couchbaseStore, opts []Option) (*couchbaseHeartBeater, error) {
 
-	go func() {
-		for {
-			select {
-			case _ = <-h.heartbeatSendCloser:
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				if err := h.sendHeartbeat(intervalMs); err != nil {
-					log.Printf("Error sending heartbeat: %v", err)
-				}
-			}
+	heartbeater := &couchbaseHeartBeater{
+		store:                  store,
+		couchbase:              couchbaseStore,
+		heartbeatDocType:       docTypeHeartbeat,
+		timeoutDocType:         docTypeHeartbeatTimeout,
+		staleDocType:           docTypeHeartbeatStale,
+		leaderDocType:          docTypeHeartbeatLeader,
+		logger:                 stdLogger{},
+		metrics:                noopMetrics{},
+		tracer:                 noopTracer{},
+		clock:                  realClock{},
+		timeoutMultiplier:      defaultTimeoutMultiplier,
+		heartbeatDocTTL:        defaultHeartbeatDocTTL,
+		sendRetries:            defaultSendRetries,
+		sendRetryDelay:         defaultSendRetryDelay,
+		staleEventsBufferSize:  defaultStaleEventsBufferSize,
+		errorsBufferSize:       defaultErrorsBufferSize,
+		staleNodes:             map[string]struct{}{},
+		missedChecks:           map[string]int{},
+		singleDocNodes:         map[string]heartbeatMeta{},
+		missedSince:            map[string]time.Time{},
+		clockSkews:             map[string]time.Duration{},
+		sequences:              map[string]uint64{},
+		phiDetectors:           map[string]*phiDetector{},
+		staleAfterMissedChecks: defaultStaleAfterMissedChecks,
+	}
+	for _, opt := range opts {
+		opt(heartbeater)
+	}
+	if err := heartbeater.validate(); err != nil {
+		return nil, err
+	}
+	heartbeater.staleEvents = make(chan string, heartbeater.staleEventsBufferSize)
+	heartbeater.errors = make(chan error, heartbeater.errorsBufferSize)
+	couchbaseStore.keyPrefix = heartbeater.keyPrefix
+	couchbaseStore.docId = heartbeater.docId
+	couchbaseStore.logger = heartbeater.logger
+	couchbaseStore.metrics = heartbeater.metrics
+	return heartbeater, nil
+
+}
+
+// Couchbase Server rejects keys longer than this many bytes
+const maxDocIdLength = 250
+
+// Catch options that would only fail later, eg a nodeUuid or keyPrefix that
+// would make the doc ids unusable, at construction rather than the node
+// silently never taking part.  Both may contain ":" and the nodeUuid may
+// contain whitespace, eg a host:port or IPv6 address, see docId.
+func (h *couchbaseHeartBeater) validate() error {
+
+	if h.staleEventsBufferSize < 0 {
+		return fmt.Errorf("Invalid stale events buffer size %v: must not be negative", h.staleEventsBufferSize)
+	}
+	if h.errorsBufferSize < 0 {
+		return fmt.Errorf("Invalid errors buffer size %v: must not be negative", h.errorsBufferSize)
+	}
+	if !(h.timeoutMultiplier > 0) {
+		// the timeout doc would be written with a TTL of 0, ie never expire,
+		// or NaN
+		return fmt.Errorf("Invalid timeout multiplier %v: must be positive", h.timeoutMultiplier)
+	}
+	if !(h.jitter >= 0 && h.jitter < 1) {
+		return fmt.Errorf("Invalid jitter %v: must be at least 0 and less than 1", h.jitter)
+	}
+	if h.nodeUuid == "" && !h.observer {
+		// observers don't need a nodeUuid, since they never write one
+		return fmt.Errorf("Invalid nodeUuid: must not be empty")
+	}
+	if strings.IndexFunc(h.nodeUuid, isControlNotSpace) >= 0 {
+		return fmt.Errorf("Invalid nodeUuid %q: must not contain control characters", h.nodeUuid)
+	}
+	if strings.IndexFunc(h.keyPrefix, unicode.IsControl) >= 0 {
+		return fmt.Errorf("Invalid keyPrefix %q: must not contain control characters", h.keyPrefix)
+	}
+	if h.docIdFunc != nil {
+		return h.validateDocIdFunc()
+	}
+	if docId := h.heartbeatTimeoutDocId(h.nodeUuid); len(docId) > maxDocIdLength {
+		return fmt.Errorf("Invalid keyPrefix %q and nodeUuid %q: doc id %v is longer than %v bytes",
+			h.keyPrefix, h.nodeUuid, docId, maxDocIdLength)
+	}
+	return nil
+
+}
+
+// Check that the function passed to WithDocIdFunc gives this node's docs
+// usable ids which don't collide with each other
+func (h *couchbaseHeartBeater) validateDocIdFunc() error {
+
+	docIds := map[string]string{}
+	for _, kind := range []string{DocKindHeartbeat, DocKindHeartbeatTimeout, DocKindHeartbeatStale} {
+		docId := h.docId(kind, h.nodeUuid)
+		if docId == "" || len(docId) > maxDocIdLength {
+			return fmt.Errorf("Invalid DocIdFunc: %v doc id %q for nodeUuid %q must be 1 to %v bytes",
+				kind, docId, h.nodeUuid, maxDocIdLength)
 		}
-	}()
+		if otherKind, ok := docIds[docId]; ok {
+			return fmt.Errorf("Invalid DocIdFunc: %v and %v docs both have id %q", otherKind, kind, docId)
+		}
+		docIds[docId] = kind
+	}
 	return nil
 
 }
 
-// Stop sending heartbeats
-func (h *couchbaseHeartBeater) StopSendingHeartbeats() {
-	close(h.heartbeatSendCloser)
+// Kick off the heartbeat sender with the given interval, in milliseconds.
+//
+// Deprecated: use StartSendingHeartbeatsContext, which takes a time.Duration.
+func (h *couchbaseHeartBeater) StartSendingHeartbeats(intervalMs int) error {
+	return h.StartSendingHeartbeatsContext(context.Background(), time.Duration(intervalMs)*time.Millisecond)
 }
 
-// Kick off the heartbeat checker and pass in the amount of time in milliseconds before
-// a node has been considered to stop sending heartbeats.  Also pass in the handler which
-// will be called back in that case (and passed the opaque node uuid)
-func (h *couchbaseHeartBeater) StartCheckingHeartbeats(staleThresholdMs int, handler HeartbeatsStoppedHandler) error {
+// Kick off the heartbeat sender with the given interval.  The first heartbeat
+// is written before this returns, so that other nodes can see this node
+// straight away rather than after the first interval.  The sender will stop
+// when either StopSendingHeartbeats is called or the given context is
+// cancelled.  Returns ErrAlreadyRunning if the sender is already running.
+func (h *couchbaseHeartBeater) StartSendingHeartbeatsContext(ctx context.Context, interval time.Duration) error {
 
-	if err := h.addHeartbeatCheckView(); err != nil {
-		return err
+	if h.observer {
+		return ErrObserver
+	}
+	if interval <= 0 {
+		return fmt.Errorf("Invalid send interval %v: must be positive", interval)
 	}
+	closer, ok := h.beginRun(&h.heartbeatSendCloser)
+	if !ok {
+		return ErrAlreadyRunning
+	}
+
+	// also cancelled when this run is stopped, so that a heartbeat which is
+	// waiting to be retried gives up straight away
+	ctx, cancel := context.WithCancel(ctx)
+	h.goroutines.Add(1)
+	go func() {
+		defer h.goroutines.Done()
+		defer cancel()
+		select {
+		case <-closer:
+		case <-ctx.Done():
+		}
+	}()
+
+	h.setSendInterval(interval)
+	h.recordAttempt(&h.lastSendAttempt)
+	h.sendAndRecordHeartbeat(ctx, interval)
 
-	ticker := time.NewTicker(time.Duration(staleThresholdMs) * time.Millisecond)
+	// use a timer rather than a ticker, so that each wait can be jittered
+	// and the interval can be changed while running
+	timer := h.clock.NewTimer(h.jitteredInterval(interval))
 
+	h.goroutines.Add(1)
 	go func() {
+		defer h.goroutines.Done()
 		for {
 			select {
-			case _ = <-h.heartbeatCheckCloser:
-				ticker.Stop()
+			case _ = <-closer:
+				timer.Stop()
+				h.stopLeading()
+				return
+			case <-ctx.Done():
+				h.endRun(&h.heartbeatSendCloser, closer)
+				timer.Stop()
+				h.stopLeading()
 				return
-			case <-ticker.C:
-				if err := h.checkStaleHeartbeats(staleThresholdMs, handler); err != nil {
-					log.Printf("Error checking for stale heartbeats: %v", err)
+			case <-timer.C():
+				h.recordAttempt(&h.lastSendAttempt)
+				interval := h.getSendInterval()
+				if atomic.LoadInt32(&h.sendPaused) == 0 {
+					h.sendAndRecordHeartbeat(ctx, interval)
+				} else {
+					h.stepDown()
 				}
+				timer.Reset(h.jitteredInterval(interval))
 			}
 		}
 	}()
@@ -141,171 +663,1560 @@ func (h *couchbaseHeartBeater) StartCheckingHeartbeats(staleThresholdMs int, han
 
 }
 
-// Stop the heartbeat checker
-func (h *couchbaseHeartBeater) StopCheckingHeartbeats() {
-	close(h.heartbeatCheckCloser)
+// Send a heartbeat, and log and record the outcome.  Errors aren't returned
+// since the sender just tries again next time.
+func (h *couchbaseHeartBeater) sendAndRecordHeartbeat(ctx context.Context, interval time.Duration) {
+	defer h.recoverPanic(OpSend)
+	err := h.trace(ctx, "cbheartbeat.SendHeartbeat", "", func(ctx context.Context) error {
+		return h.sendHeartbeat(ctx, interval)
+	})
+	if err != nil {
+		h.logger.Printf("Error sending heartbeat: %v", err)
+		h.sendError(OpSend, h.nodeUuid, err)
+	}
+	h.recordSendResult(err)
+	h.metrics.HeartbeatSent(err)
+	h.runLeaderElection(ctx, interval, err)
 }
 
-func (h couchbaseHeartBeater) checkStaleHeartbeats(staleThresholdMs int, handler HeartbeatsStoppedHandler) error {
+// Replace the metadata that is stored in this node's heartbeat doc, eg its
+// hostname, address or version, so that other nodes can discover it.  The
+// new metadata is written with the next heartbeat.
+func (h *couchbaseHeartBeater) SetMetadata(metadata map[string]string) {
+	h.metadataMutex.Lock()
+	defer h.metadataMutex.Unlock()
+	h.metadata = copyMetadata(metadata)
+	h.heartbeatDocDirty = true
+}
 
-	// query view to get all heartbeat docs
-	heartbeatDocs, err := h.viewQueryHeartbeatDocs()
-	if err != nil {
-		return err
+func (h *couchbaseHeartBeater) getMetadata() map[string]string {
+	h.metadataMutex.Lock()
+	defer h.metadataMutex.Unlock()
+	return h.metadata
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	metadataCopy := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		metadataCopy[k] = v
 	}
+	return metadataCopy
+}
 
-	for _, heartbeatDoc := range heartbeatDocs {
-		if heartbeatDoc.NodeUUID == h.nodeUuid {
-			// that's us, and we don't care about ourselves
-			continue
-		}
-		if heartbeatDoc.NodeUUID == "" {
-			log.Printf("Skipping invalid heartbeatDoc: %+v", heartbeatDoc)
-			continue
-		}
-		timeoutDocId := h.heartbeatTimeoutDocId(heartbeatDoc.NodeUUID)
-		heartbeatTimeoutDoc := heartbeatTimeout{}
-		err := h.bucket.Get(timeoutDocId, &heartbeatTimeoutDoc)
-		if err != nil {
-			if !couchbase.IsKeyNoEntError(err) {
-				// unexpected error
-				return err
-			}
+// Change the interval of a running heartbeat sender.  Takes effect at the
+// next heartbeat, which still fires on the old schedule so that no beat is
+// missed, but writes a timeout doc TTL based on the new interval and then
+// waits the new interval before the one after.  The interval must be
+// positive.
+func (h *couchbaseHeartBeater) SetSendInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid send interval %v: must be positive", interval)
+	}
+	h.setSendInterval(interval)
+	return nil
+}
 
-			// doc not found, which means the heartbeat doc expired.
-			// call back the handler.
-			handler.StaleHeartBeatDetected(heartbeatDoc.NodeUUID)
+func (h *couchbaseHeartBeater) setSendInterval(interval time.Duration) {
+	h.warnIfTimeoutTooShort(interval)
+	h.sendIntervalMutex.Lock()
+	defer h.sendIntervalMutex.Unlock()
+	h.sendInterval = interval
+}
 
-			// delete the heartbeat doc itself so we don't have unwanted
-			// repeated callbacks to the stale heartbeat handler
-			docId := h.heartbeatDocId(heartbeatDoc.NodeUUID)
-			if err := h.bucket.Delete(docId); err != nil {
-				log.Printf("Failed to delete heartbeat doc: %v err: %v", docId, err)
-			}
+// Log a warning if the heartbeat timeout doc would expire before the next
+// heartbeat renews it, which makes this node flap between alive and stale.
+// This happens if the timeout multiplier is 1 or less without a grace
+// period, or if there isn't enough slack left for the send retries.
+func (h *couchbaseHeartBeater) warnIfTimeoutTooShort(interval time.Duration) {
 
-		}
+	ttl := h.timeoutTTL(interval)
+	if ttl <= interval {
+		h.logger.Printf("Warning: heartbeat timeout doc TTL %v is not longer than the send interval %v, "+
+			"so this node will keep looking stale.  Increase WithTimeoutMultiplier or WithTimeoutGracePeriod.", ttl, interval)
+		return
+	}
 
+	// the total time spent sleeping between retries, in the worst case
+	retryTime := time.Duration(0)
+	delay := h.sendRetryDelay
+	for i := 0; i < h.sendRetries; i++ {
+		retryTime += delay
+		delay *= 2
 	}
-	return nil
+	if ttl-interval <= retryTime {
+		h.logger.Printf("Warning: heartbeat timeout doc TTL %v leaves less than the %v that send retries can take "+
+			"on top of the send interval %v, so this node may look stale when writes are slow.", ttl, retryTime, interval)
+	}
+
 }
 
-func (h couchbaseHeartBeater) heartbeatTimeoutDocId(nodeUuid string) string {
-	return fmt.Sprintf("%vheartbeat_timeout:%v", h.keyPrefix, nodeUuid)
+func (h *couchbaseHeartBeater) getSendInterval() time.Duration {
+	h.sendIntervalMutex.Lock()
+	defer h.sendIntervalMutex.Unlock()
+	return h.sendInterval
 }
 
-func (h couchbaseHeartBeater) heartbeatDocId(nodeUuid string) string {
-	return fmt.Sprintf("%vheartbeat:%v", h.keyPrefix, nodeUuid)
+// Randomize the interval by up to +/- the configured jitter fraction, so that
+// nodes which were started at the same time don't all write at once.  The
+// result is capped halfway between the interval and the timeout doc TTL, so
+// that jitter alone can never make this node look stale, and floored at half
+// the interval, so that it can never make the sender write in a tight loop.
+func (h *couchbaseHeartBeater) jitteredInterval(interval time.Duration) time.Duration {
+
+	if h.jitter <= 0 {
+		return interval
+	}
+	jittered := interval + time.Duration((rand.Float64()*2-1)*h.jitter*float64(interval))
+	if limit := (interval + h.timeoutTTL(interval)) / 2; jittered > limit {
+		jittered = limit
+	}
+	if floor := interval / 2; jittered < floor {
+		jittered = floor
+	}
+	return jittered
+
 }
 
-func (h couchbaseHeartBeater) viewQueryHeartbeatDocs() ([]heartbeatMeta, error) {
+// The time of the last heartbeat that was successfully written to Couchbase
+// (the zero time if none have been), and the error from the most recent
+// attempt (nil if it succeeded).  Useful for wiring up a liveness probe.
+func (h *couchbaseHeartBeater) SenderHealth() (lastSuccess time.Time, lastErr error) {
+	h.senderHealthMutex.Lock()
+	defer h.senderHealthMutex.Unlock()
+	return h.lastSendSuccess, h.lastSendErr
+}
 
-	viewRes := struct {
-		Rows []struct {
-			Id    string
-			Value string
-		}
-		Errors []couchbase.ViewError
-	}{}
+// When the sender last woke up to send a heartbeat, whether or not it
+// succeeded, or was paused, or the zero time if it hasn't started.  This
+// advances once every send interval while the sender is running, so a
+// readiness probe can tell that the sender goroutine is stuck if it falls
+// more than a couple of intervals behind.  See also SenderHealth.
+func (h *couchbaseHeartBeater) LastSendAttempt() time.Time {
+	return loadAttempt(&h.lastSendAttempt)
+}
 
-	err := h.bucket.ViewCustom("cbgt", "heartbeats",
-		map[string]interface{}{
-			"stale": false,
-		}, &viewRes)
-	if err != nil {
-		return nil, err
+// When the checker last started a check, whether or not it succeeded, or the
+// zero time if it hasn't.  This advances once every check interval (the
+// stale threshold unless WithCheckInterval is used) while the checker is
+// running, as well as on CheckNow and RunCheck.
+func (h *couchbaseHeartBeater) LastCheckAttempt() time.Time {
+	return loadAttempt(&h.lastCheckAttempt)
+}
+
+func (h *couchbaseHeartBeater) recordAttempt(attempt *int64) {
+	atomic.StoreInt64(attempt, h.clock.Now().UnixNano())
+}
+
+func loadAttempt(attempt *int64) time.Time {
+	nanos := atomic.LoadInt64(attempt)
+	if nanos == 0 {
+		return time.Time{}
 	}
+	return time.Unix(0, nanos)
+}
 
-	heartbeats := []heartbeatMeta{}
-	for _, row := range viewRes.Rows {
-		heartbeat := heartbeatMeta{
-			Type:     docTypeHeartbeat,
-			NodeUUID: row.Value,
-		}
-		heartbeats = append(heartbeats, heartbeat)
+func (h *couchbaseHeartBeater) recordSendResult(err error) {
+
+	h.senderHealthMutex.Lock()
+	if err == nil {
+		h.lastSendSuccess = h.clock.Now()
+		h.sendFailures = 0
+	} else {
+		h.sendFailures++
+	}
+	h.lastSendErr = err
+	failures := h.sendFailures
+	becameUnhealthy := err != nil && h.selfUnhealthyHandler != nil && !h.selfUnhealthy && failures >= h.selfUnhealthyAfter
+	recovered := h.selfUnhealthy && err == nil
+	if becameUnhealthy || recovered {
+		h.selfUnhealthy = becameUnhealthy
 	}
+	h.senderHealthMutex.Unlock()
 
-	return heartbeats, nil
+	// call back outside the lock, so the handler can call SenderHealth
+	switch {
+	case becameUnhealthy:
+		h.callHandler(h.nodeUuid, func() {
+			h.selfUnhealthyHandler.SelfUnhealthy(failures, err)
+		})
+	case recovered:
+		h.callHandler(h.nodeUuid, func() {
+			h.selfUnhealthyHandler.SelfRecovered()
+		})
+	}
+
+}
 
+// Stop sending heartbeats.  Safe to call more than once, and the sender can
+// be started again afterwards.
+func (h *couchbaseHeartBeater) StopSendingHeartbeats() {
+	h.endRun(&h.heartbeatSendCloser, nil)
 }
 
-func (h couchbaseHeartBeater) sendHeartbeat(intervalMs int) error {
+// Kick off both the heartbeat sender and checker, for the common case of a
+// node which both sends heartbeats and watches the others'.  If either fails
+// to start, the other one is stopped again, so that nothing is left running.
+// With WithObserver, only the checker is started.
+func (h *couchbaseHeartBeater) Start(sendInterval, staleThreshold time.Duration, handler HeartbeatsStoppedHandler) error {
 
-	if err := h.upsertHeartbeatDoc(); err != nil {
-		return err
+	if !h.observer {
+		if err := h.StartSendingHeartbeatsContext(context.Background(), sendInterval); err != nil {
+			return fmt.Errorf("Starting heartbeat sender: %w", err)
+		}
 	}
-	if err := h.upsertHeartbeatTimeoutDoc(intervalMs); err != nil {
-		return err
+	if err := h.StartCheckingHeartbeatsContext(context.Background(), staleThreshold, handler); err != nil {
+		if !h.observer {
+			h.StopSendingHeartbeats()
+		}
+		return fmt.Errorf("Starting heartbeat checker: %w", err)
 	}
 	return nil
+
 }
 
-func (h couchbaseHeartBeater) upsertHeartbeatDoc() error {
+// Stop both the heartbeat sender and checker, see Start.  Use Wait to wait
+// for them to exit.
+func (h *couchbaseHeartBeater) Stop() {
+	h.StopSendingHeartbeats()
+	h.StopCheckingHeartbeats()
+}
 
-	heartbeatDoc := heartbeatMeta{
-		Type:     docTypeHeartbeat,
-		NodeUUID: h.nodeUuid,
+// Record that the sender or checker, whichever closer belongs to, is
+// running, and return the channel that stops this run of it.  Each run gets
+// its own channel, so that it can be stopped and started again.
+func (h *couchbaseHeartBeater) beginRun(closer *chan struct{}) (chan struct{}, bool) {
+	h.runMutex.Lock()
+	defer h.runMutex.Unlock()
+	if *closer != nil {
+		return nil, false
 	}
-	docId := h.heartbeatDocId(h.nodeUuid)
+	*closer = make(chan struct{})
+	return *closer, true
+}
 
-	if err := h.bucket.Set(docId, 0, heartbeatDoc); err != nil {
-		return err
+// Stop the given run of the sender or checker, or whichever run is current
+// if run is nil.  Does nothing if that run has already been stopped.
+func (h *couchbaseHeartBeater) endRun(closer *chan struct{}, run chan struct{}) {
+	h.runMutex.Lock()
+	defer h.runMutex.Unlock()
+	if *closer == nil || (run != nil && *closer != run) {
+		return
 	}
-	return nil
+	close(*closer)
+	*closer = nil
+}
 
+// Block until the sender and checker goroutines have exited, after they have
+// been stopped with StopSendingHeartbeats / StopCheckingHeartbeats or by
+// cancelling their contexts.  With WithAsyncHandlers, this also waits for
+// any handler calls that are still running.  Once this returns, no more
+// heartbeat docs will be written or deleted, so it is safe to Deregister or
+// close the bucket.
+func (h *couchbaseHeartBeater) Wait() {
+	h.goroutines.Wait()
 }
 
-func (h couchbaseHeartBeater) upsertHeartbeatTimeoutDoc(intervalMs int) error {
+// Temporarily stop writing heartbeats, while keeping the sender running.
+// Once the heartbeat timeout doc expires, other nodes will see this node as
+// stale, which is handy for draining it before a real shutdown.
+func (h *couchbaseHeartBeater) PauseSending() {
+	atomic.StoreInt32(&h.sendPaused, 1)
+}
 
-	heartbeatTimeoutDoc := heartbeatTimeout{
-		Type:     docTypeHeartbeatTimeout,
-		NodeUUID: h.nodeUuid,
-	}
+// Start writing heartbeats again after PauseSending, from the next interval
+func (h *couchbaseHeartBeater) ResumeSending() {
+	atomic.StoreInt32(&h.sendPaused, 0)
+}
 
-	docId := h.heartbeatTimeoutDocId(h.nodeUuid)
+// Stop the sender and checker, wait for them to exit, deregister this node
+// if WithDeregisterOnClose was passed, and then close the store, which for
+// the default store releases the bucket.  The heartbeater can't be used
+// afterwards.  Safe to call more than once, and without having started the
+// sender or checker.
+func (h *couchbaseHeartBeater) Close() error {
+
+	h.closeOnce.Do(func() {
+		h.Stop()
+		h.Wait()
+		if h.deregisterOnClose {
+			if err := h.Deregister(); err != nil {
+				h.closeErr = err
+			}
+		}
+		if err := h.store.Close(); err != nil && h.closeErr == nil {
+			h.closeErr = err
+		}
+	})
+	return h.closeErr
+
+}
 
-	expireTimeSeconds := (intervalMs / 1000)
+// Delete this node's heartbeat docs so that other nodes see it as gone
+// immediately, rather than waiting for the heartbeat timeout doc to expire.
+// Call this after StopSendingHeartbeats when shutting down cleanly.  It is
+// not an error if the docs have already been deleted.
+func (h *couchbaseHeartBeater) Deregister() error {
 
-	// make the expire time double the interval time, to ensure there is
-	// always a heartbeat timeout document present under normal operation
-	expireTimeSeconds *= 2
+	if h.observer {
+		// never wrote anything
+		return nil
+	}
 
-	if err := h.bucket.Set(docId, expireTimeSeconds, heartbeatTimeoutDoc); err != nil {
+	if err := h.releaseLeadership(); err != nil {
 		return err
 	}
+
+	// delete the heartbeat doc first, otherwise a checker could see it
+	// without a timeout doc and report this node as stale
+	docIds := []string{
+		h.heartbeatDocId(h.nodeUuid),
+		h.heartbeatTimeoutDocId(h.nodeUuid),
+	}
+	for _, docId := range docIds {
+		err := h.trace(context.Background(), "cbheartbeat.Delete", docId, func(ctx context.Context) error {
+			return h.store.Delete(docId)
+		})
+		if err != nil && err != ErrDocNotFound {
+			return err
+		}
+	}
 	return nil
 
 }
 
-func (h *couchbaseHeartBeater) getBucket() (*couchbase.Bucket, error) {
-	if h.bucket == nil {
-		bucket, err := couchbase.GetBucket(h.couchbaseUrlStr, "default", h.bucketName)
-		if err != nil {
-			return nil, err
+// Kick off the heartbeat checker and pass in the amount of time in milliseconds before
+// a node has been considered to stop sending heartbeats.  Also pass in the handler which
+// will be called back in that case (and passed the opaque node uuid)
+//
+// Deprecated: use StartCheckingHeartbeatsContext, which takes a time.Duration.
+func (h *couchbaseHeartBeater) StartCheckingHeartbeats(staleThresholdMs int, handler HeartbeatsStoppedHandler) error {
+	return h.StartCheckingHeartbeatsContext(context.Background(), time.Duration(staleThresholdMs)*time.Millisecond, handler)
+}
+
+// Kick off the heartbeat checker and pass in the amount of time before a node has been
+// considered to stop sending heartbeats, and the handler which will be called back in
+// that case (which may be nil if StaleEvents is used instead).  The checker will stop
+// when either StopCheckingHeartbeats is called or the given context is cancelled.
+// The checker runs every staleThreshold, unless WithCheckInterval asks for more often.
+// Returns ErrAlreadyRunning if the checker is already running.
+func (h *couchbaseHeartBeater) StartCheckingHeartbeatsContext(ctx context.Context, staleThreshold time.Duration, handler HeartbeatsStoppedHandler) error {
+
+	if staleThreshold <= 0 {
+		return fmt.Errorf("Invalid stale threshold %v: must be positive", staleThreshold)
+	}
+	closer, ok := h.beginRun(&h.heartbeatCheckCloser)
+	if !ok {
+		return ErrAlreadyRunning
+	}
+	if !h.readOnlyChecker {
+		if err := h.store.PrepareHeartbeatQuery(h.heartbeatDocType); err != nil {
+			h.endRun(&h.heartbeatCheckCloser, closer)
+			return err
 		}
-		h.bucket = bucket
 	}
-	return h.bucket, nil
+
+	h.checkConfigMutex.Lock()
+	h.checkStarted = true
+	h.checkStaleThreshold = staleThreshold
+	h.checkConfigMutex.Unlock()
+	h.SetStaleHandler(handler)
+
+	ticker := h.clock.NewTicker(h.checkIntervalFor(staleThreshold))
+
+	h.goroutines.Add(1)
+	go func() {
+		defer h.goroutines.Done()
+		for {
+			select {
+			case _ = <-closer:
+				ticker.Stop()
+				return
+			case <-ctx.Done():
+				h.endRun(&h.heartbeatCheckCloser, closer)
+				ticker.Stop()
+				return
+			case <-ticker.C():
+				h.checkAndRecordHeartbeats(ctx, staleThreshold, h.getStaleHandler())
+			}
+		}
+	}()
+	return nil
+
+}
+
+// How often to check for stale heartbeats, which is the stale threshold
+// unless a shorter interval was given with WithCheckInterval
+func (h *couchbaseHeartBeater) checkIntervalFor(staleThreshold time.Duration) time.Duration {
+	if h.checkInterval > 0 && h.checkInterval < staleThreshold {
+		return h.checkInterval
+	}
+	return staleThreshold
 }
 
-func (h couchbaseHeartBeater) addHeartbeatCheckView() error {
+// Check for stale heartbeats straight away, rather than waiting for the
+// checker's next tick, eg after hearing from elsewhere that a node might be
+// down.  Handlers are called back as usual, before this returns unless
+// running with WithAsyncHandlers.  The checker must have been started, and
+// this is safe to call while it is running, since checks never overlap.
+// For the same reason it must not be called from a synchronous handler.
+func (h *couchbaseHeartBeater) CheckNow() error {
+	_, err := h.RunCheck()
+	return err
+}
 
-	ddocVersionKey := fmt.Sprintf("%vddocVersion", h.keyPrefix)
-	ddocVersion := 1
-	designDoc := `
-	   {
-	       "views": {
-	           "heartbeats": {
-	               "map": "function (doc, meta) { if (doc.type == 'heartbeat') { emit(meta.id, doc.node_uuid); }}"
-	           }
-	       }
-	   }`
+// Same as CheckNow, but also returns a summary of what the check found, eg
+// for logging or metrics.  The counts are filled in as far as the check got
+// even if it returns an error.
+func (h *couchbaseHeartBeater) RunCheck() (CheckResult, error) {
 
-	return couchbaseutil.UpdateView(
-		h.bucket,
-		"cbgt",
-		ddocVersionKey,
-		designDoc,
-		ddocVersion,
-	)
+	h.checkConfigMutex.Lock()
+	checkStarted, staleThreshold := h.checkStarted, h.checkStaleThreshold
+	h.checkConfigMutex.Unlock()
+
+	if !checkStarted {
+		return CheckResult{}, ErrCheckerNotStarted
+	}
+	return h.checkAndRecordHeartbeats(context.Background(), staleThreshold, h.getStaleHandler())
+
+}
+
+// Check for stale heartbeats, and log and record the outcome
+func (h *couchbaseHeartBeater) checkAndRecordHeartbeats(ctx context.Context, staleThreshold time.Duration, handler HeartbeatsStoppedHandler) (CheckResult, error) {
+	h.recordAttempt(&h.lastCheckAttempt)
+	h.checkMutex.Lock()
+	defer h.checkMutex.Unlock()
+	defer h.recoverPanic(OpCheck)
+	checkStart := h.clock.Now()
+	result := CheckResult{}
+	err := h.trace(ctx, "cbheartbeat.CheckHeartbeats", "", func(ctx context.Context) error {
+		return h.checkStaleHeartbeats(ctx, staleThreshold, handler, &result)
+	})
+	if err != nil {
+		h.logger.Printf("Error checking for stale heartbeats: %v", err)
+		h.sendError(OpCheck, "", err)
+	}
+	result.Duration = h.clock.Now().Sub(checkStart)
+	h.metrics.CheckCompleted(result.Duration, result.LiveNodes, err)
+	return result, err
+}
+
+// Deferred by each iteration of the sender and checker loops, so that a
+// panic is logged and reported on the Errors channel, and the loop carries
+// on at the next tick rather than the goroutine dying silently.
+func (h *couchbaseHeartBeater) recoverPanic(op Operation) {
+	if r := recover(); r != nil {
+		h.logger.Printf("Recovered from panic during heartbeat %v: %v\n%s", op, r, debug.Stack())
+		h.sendError(op, "", fmt.Errorf("panic: %v", r))
+	}
+}
+
+// Stop the heartbeat checker.  Safe to call more than once, and the checker
+// can be started again afterwards.
+func (h *couchbaseHeartBeater) StopCheckingHeartbeats() {
+	h.endRun(&h.heartbeatCheckCloser, nil)
+}
+
+// Check for stale heartbeats, counting what was found in result as it goes,
+// so that the counts are still there if it fails part way through
+func (h *couchbaseHeartBeater) checkStaleHeartbeats(ctx context.Context, staleThreshold time.Duration, handler HeartbeatsStoppedHandler, result *CheckResult) error {
+
+	// query view to get all heartbeat docs
+	heartbeatDocs, err := h.queryHeartbeatDocs(ctx)
+	if err != nil {
+		return err
+	}
+
+	result.HeartbeatDocs = len(heartbeatDocs)
+	missingNodes := map[string]bool{}
+	if h.singleDoc {
+		heartbeatDocs, missingNodes = h.rememberSingleDocs(heartbeatDocs)
+	}
+	checkTime := h.clock.Now()
+	clockSkews := map[string]time.Duration{}
+	defer h.setClockSkews(clockSkews)
+	sequences := map[string]uint64{}
+	defer h.setSequences(sequences)
+
+	aliveNodes, err := h.heartbeatTimeoutDocsExist(ctx, heartbeatDocs)
+	if err != nil {
+		return err
+	}
+
+	seenNodes := map[string]struct{}{}
+	defer h.prunePhiDetectors(seenNodes)
+	staleEvents := []StaleEvent{}
+
+	for _, heartbeatDoc := range heartbeatDocs {
+		if h.isSelf(heartbeatDoc.NodeUUID) {
+			// that's us, and we don't care about ourselves
+			continue
+		}
+		if heartbeatDoc.NodeUUID == "" {
+			h.logger.Printf("Skipping invalid heartbeatDoc: %+v", heartbeatDoc)
+			continue
+		}
+		seenNodes[heartbeatDoc.NodeUUID] = struct{}{}
+		alive := aliveNodes[heartbeatDoc.NodeUUID] && !missingNodes[heartbeatDoc.NodeUUID]
+		sequences[heartbeatDoc.NodeUUID] = heartbeatDoc.Sequence
+		if alive && h.sequenceStalled(heartbeatDoc) {
+			// the timeout doc hasn't expired yet, but the node hasn't
+			// written a heartbeat since the last check
+			h.logger.Printf("Heartbeat sequence stopped advancing at %v for node: %v", heartbeatDoc.Sequence, heartbeatDoc.NodeUUID)
+			alive = false
+		}
+		suspected := h.observePhi(heartbeatDoc, checkTime)
+		if alive && suspected {
+			// the timeout doc hasn't expired yet, but the heartbeats are
+			// much later than this node's history says they should be
+			h.logger.Printf("Phi accrual failure detector suspects node: %v", heartbeatDoc.NodeUUID)
+			alive = false
+		}
+		if alive {
+			result.LiveNodes++
+			if lastSeen := heartbeatDoc.LastSeen(); !lastSeen.IsZero() && !heartbeatDoc.Minimal {
+				clockSkews[heartbeatDoc.NodeUUID] = h.checkClockSkew(heartbeatDoc.NodeUUID, lastSeen.Sub(checkTime))
+			}
+			delete(h.missedChecks, heartbeatDoc.NodeUUID)
+			delete(h.missedSince, heartbeatDoc.NodeUUID)
+			if h.clearStale(heartbeatDoc.NodeUUID) {
+				// we reported this node as stale earlier, but it's back
+				h.releaseStaleNotification(ctx, heartbeatDoc.NodeUUID)
+				h.notifyRejoined(handler, heartbeatDoc.NodeUUID)
+			}
+		} else {
+
+			if h.isExcluded(heartbeatDoc.NodeUUID) {
+				// known to be down on purpose, eg a cold standby, so
+				// there's no need to remember its single doc either
+				delete(h.singleDocNodes, heartbeatDoc.NodeUUID)
+				continue
+			}
+
+			if h.keepsStaleDocs() && h.isStale(heartbeatDoc.NodeUUID) {
+				// the heartbeat doc was kept when we reported this node
+				// stale, so don't report it again
+				delete(h.singleDocNodes, heartbeatDoc.NodeUUID)
+				continue
+			}
+
+			// doc not found, which means the heartbeat doc expired.  Unless
+			// it has been missing for enough consecutive checks, and, when
+			// checking more often than the stale threshold of a node which
+			// doesn't advertise its own timeout, for long enough, give the
+			// node the benefit of the doubt for now.  The phi accrual
+			// detector has already allowed for that if it suspects the node.
+			h.missedChecks[heartbeatDoc.NodeUUID]++
+			if _, ok := h.missedSince[heartbeatDoc.NodeUUID]; !ok {
+				h.missedSince[heartbeatDoc.NodeUUID] = checkTime
+			}
+			missingFor := checkTime.Sub(h.missedSince[heartbeatDoc.NodeUUID])
+			nodeStaleThreshold, ownTimeout := h.staleThresholdFor(heartbeatDoc, h.missedChecks[heartbeatDoc.NodeUUID], staleThreshold)
+			if !suspected {
+				if h.missedChecks[heartbeatDoc.NodeUUID] < h.staleAfterMissedChecks {
+					continue
+				}
+				if !ownTimeout && missingFor < nodeStaleThreshold-h.checkIntervalFor(staleThreshold) {
+					continue
+				}
+			}
+			delete(h.missedChecks, heartbeatDoc.NodeUUID)
+			delete(h.missedSince, heartbeatDoc.NodeUUID)
+			delete(h.singleDocNodes, heartbeatDoc.NodeUUID)
+			h.markStale(heartbeatDoc.NodeUUID)
+			result.StaleNodes++
+			staleEvents = append(staleEvents, newStaleEvent(heartbeatDoc, checkTime, nodeStaleThreshold))
+
+		}
+
+	}
+
+	result.DeleteFailures += h.handleStaleNodes(ctx, staleEvents, staleThreshold, handler)
+	return nil
+}
+
+// Notify about, and delete the heartbeat docs of, the nodes found stale by a
+// check, spread across WithCheckWorkers goroutines.  Returns how many docs
+// couldn't be deleted.
+func (h *couchbaseHeartBeater) handleStaleNodes(ctx context.Context, staleEvents []StaleEvent, staleThreshold time.Duration, handler HeartbeatsStoppedHandler) int {
+
+	h.beginHandlerBudget()
+	defer h.endHandlerBudget(handler)
+
+	deleteFailures := 0
+	if h.checkWorkers <= 1 || len(staleEvents) <= 1 {
+		for _, event := range staleEvents {
+			if !h.handleStaleNode(ctx, event, staleThreshold, handler) {
+				deleteFailures++
+			}
+		}
+		return deleteFailures
+	}
+
+	var mutex sync.Mutex
+	var workers sync.WaitGroup
+	events := make(chan StaleEvent)
+	for i := 0; i < h.checkWorkers && i < len(staleEvents); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for event := range events {
+				if !h.handleStaleNode(ctx, event, staleThreshold, handler) {
+					mutex.Lock()
+					deleteFailures++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, event := range staleEvents {
+		events <- event
+	}
+	close(events)
+	workers.Wait()
+	return deleteFailures
+
+}
+
+// Notify about a stale node, and delete its heartbeat doc.  Returns false
+// if the doc couldn't be deleted.
+func (h *couchbaseHeartBeater) handleStaleNode(ctx context.Context, event StaleEvent, staleThreshold time.Duration, handler HeartbeatsStoppedHandler) bool {
+
+	// call back the handler, unless another checker beat us to it.
+	if h.claimStaleNotification(ctx, event.NodeUUID, staleThreshold) {
+		if h.takeHandlerBudget(event) {
+			h.notifyStale(handler, event)
+		}
+		h.sendStaleEvent(event.NodeUUID)
+		h.metrics.StaleNodeDetected(event.NodeUUID)
+	}
+
+	if h.keepsStaleDocs() {
+		return true
+	}
+
+	// delete the heartbeat doc itself so we don't have unwanted
+	// repeated callbacks to the stale heartbeat handler
+	docId := h.heartbeatDocId(event.NodeUUID)
+	err := h.trace(ctx, "cbheartbeat.Delete", docId, func(ctx context.Context) error {
+		return h.store.Delete(docId)
+	})
+	if err != nil && err != ErrDocNotFound {
+		h.logger.Printf("Failed to delete heartbeat doc: %v err: %v", docId, err)
+		h.sendError(OpDelete, event.NodeUUID, err)
+		return false
+	}
+	return true
+
+}
+
+// Log a warning if the skew is beyond the configured threshold, and return it
+func (h *couchbaseHeartBeater) checkClockSkew(nodeUuid string, skew time.Duration) time.Duration {
+	if h.clockSkewWarning > 0 && (skew > h.clockSkewWarning || skew < -h.clockSkewWarning) {
+		h.logger.Printf("Clock skew of %v detected for node: %v", skew, nodeUuid)
+	}
+	return skew
+}
+
+func (h *couchbaseHeartBeater) setClockSkews(clockSkews map[string]time.Duration) {
+	h.clockSkewMutex.Lock()
+	defer h.clockSkewMutex.Unlock()
+	h.clockSkews = clockSkews
+}
+
+// The approximate difference between the given node's clock and ours, as of
+// the last heartbeat check, found by comparing the time in its heartbeat doc
+// with our own time.  Positive if the node's clock is ahead.  The doc may be
+// up to one send interval old, so small negative values are normal.  Zero
+// if unknown, eg if the checker isn't running or the node isn't live.
+func (h *couchbaseHeartBeater) ClockSkew(nodeUuid string) time.Duration {
+	h.clockSkewMutex.Lock()
+	defer h.clockSkewMutex.Unlock()
+	return h.clockSkews[nodeUuid]
+}
+
+// When running with WithSequenceChecking, has the node's heartbeat sequence
+// stayed the same since the last check?
+func (h *couchbaseHeartBeater) sequenceStalled(heartbeatDoc heartbeatMeta) bool {
+	if !h.checkSequences || heartbeatDoc.Sequence == 0 || heartbeatDoc.Minimal {
+		return false
+	}
+	lastSequence, ok := h.lastSequence(heartbeatDoc.NodeUUID)
+	return ok && lastSequence == heartbeatDoc.Sequence
+}
+
+func (h *couchbaseHeartBeater) setSequences(sequences map[string]uint64) {
+	h.sequencesMutex.Lock()
+	defer h.sequencesMutex.Unlock()
+	h.sequences = sequences
+}
+
+func (h *couchbaseHeartBeater) lastSequence(nodeUuid string) (uint64, bool) {
+	h.sequencesMutex.Lock()
+	defer h.sequencesMutex.Unlock()
+	sequence, ok := h.sequences[nodeUuid]
+	return sequence, ok
+}
+
+// The sequence number in the given node's heartbeat doc as of the last
+// heartbeat check.  Each node increments its sequence with every heartbeat,
+// starting from 1 when its sender starts.  Zero if unknown, eg if the
+// checker isn't running or the node is running an older version of this
+// library.
+func (h *couchbaseHeartBeater) LastSequence(nodeUuid string) uint64 {
+	sequence, _ := h.lastSequence(nodeUuid)
+	return sequence
+}
+
+// The stale threshold for the given node, which has now been missing for
+// consecutiveMisses checks in a row.  That's the one from
+// WithStaleThresholdFunc if set, and otherwise the timeout the node
+// advertises in its heartbeat doc, in which case ownTimeout is true.  Its
+// timeout doc expiring then already means the node has been silent for its
+// own timeout, so the checker's threshold isn't applied on top.  Nodes
+// running older versions don't advertise one, so get the checker's.
+func (h *couchbaseHeartBeater) staleThresholdFor(heartbeatDoc heartbeatMeta, consecutiveMisses int, staleThreshold time.Duration) (threshold time.Duration, ownTimeout bool) {
+	if h.staleThresholdFunc != nil {
+		return h.staleThresholdFunc(heartbeatDoc.NodeUUID, consecutiveMisses), false
+	}
+	if heartbeatDoc.TimeoutMs > 0 {
+		return time.Duration(heartbeatDoc.TimeoutMs) * time.Millisecond, true
+	}
+	return staleThreshold, false
+}
+
+// Never report the given nodes as stale, eg cold standbys which are
+// expected to be down, replacing any nodes excluded by an earlier call.
+// Takes effect from the next check.  Their heartbeat docs are left alone,
+// and they are still reported as rejoined if they were stale before being
+// excluded and then come back.  See also WithExcludeNodeFunc.
+func (h *couchbaseHeartBeater) SetExcludedNodes(nodeUuids []string) {
+	excludedNodes := make(map[string]struct{}, len(nodeUuids))
+	for _, nodeUuid := range nodeUuids {
+		excludedNodes[nodeUuid] = struct{}{}
+	}
+	h.excludeMutex.Lock()
+	defer h.excludeMutex.Unlock()
+	h.excludedNodes = excludedNodes
+}
+
+func (h *couchbaseHeartBeater) isExcluded(nodeUuid string) bool {
+	h.excludeMutex.Lock()
+	_, excluded := h.excludedNodes[nodeUuid]
+	h.excludeMutex.Unlock()
+	return excluded || (h.excludeNodeFunc != nil && h.excludeNodeFunc(nodeUuid))
+}
+
+// Whether the checker leaves the heartbeat docs of stale nodes alone, and
+// remembers which nodes it has reported instead
+func (h *couchbaseHeartBeater) keepsStaleDocs() bool {
+	return h.keepStaleDocs || h.readOnlyChecker
+}
+
+// When running with WithSingleNotifier, atomically create a marker doc for
+// the stale node so that only the first checker to do so notifies about it.
+// Returns true if this checker should notify.  The marker expires after a
+// few check cycles, so that the node can be reported again if it rejoins
+// and then goes stale again later.
+func (h *couchbaseHeartBeater) claimStaleNotification(ctx context.Context, nodeUuid string, staleThreshold time.Duration) bool {
+
+	if !h.usesStaleMarkers() {
+		return true
+	}
+
+	staleDoc := heartbeatStale{
+		Type:       h.staleDocType,
+		NodeUUID:   nodeUuid,
+		ReportedBy: h.nodeUuid,
+	}
+	markerTTL := h.staleMarkerTTL
+	if markerTTL <= 0 {
+		markerTTL = staleThreshold * time.Duration(h.staleAfterMissedChecks+2)
+	}
+	docId := h.heartbeatStaleDocId(nodeUuid)
+	added := false
+	err := h.trace(ctx, "cbheartbeat.Insert", docId, func(ctx context.Context) error {
+		var err error
+		added, err = h.store.Insert(docId, staleDoc, markerTTL)
+		return err
+	})
+	if err != nil {
+		// better to notify twice than not at all
+		h.logger.Printf("Error claiming stale notification for node: %v err: %v", nodeUuid, err)
+		h.sendError(OpCheck, nodeUuid, err)
+		return true
+	}
+	return added
+
+}
+
+// Whether stale nodes are claimed with a marker doc before notifying, see
+// WithSingleNotifier and WithStaleMarkerTTL
+func (h *couchbaseHeartBeater) usesStaleMarkers() bool {
+	return (h.singleNotifier || h.staleMarkerTTL > 0) && !h.readOnlyChecker
+}
+
+// Delete the marker doc claimed for a node which has since rejoined, so
+// that it is reported again if it goes stale again before the marker would
+// have expired
+func (h *couchbaseHeartBeater) releaseStaleNotification(ctx context.Context, nodeUuid string) {
+	if !h.usesStaleMarkers() {
+		return
+	}
+	docId := h.heartbeatStaleDocId(nodeUuid)
+	err := h.trace(ctx, "cbheartbeat.Delete", docId, func(ctx context.Context) error {
+		return h.store.Delete(docId)
+	})
+	if err != nil && err != ErrDocNotFound {
+		h.logger.Printf("Error deleting stale marker for node: %v err: %v", nodeUuid, err)
+	}
+}
+
+// Get the uuids of all other nodes which currently have a heartbeat timeout
+// doc that has not yet expired.  This queries Couchbase directly rather than
+// waiting for the heartbeat checker to run.
+func (h *couchbaseHeartBeater) LiveNodes() ([]string, error) {
+	return h.LiveNodesContext(context.Background())
+}
+
+// Same as LiveNodes, but gives up and returns ctx.Err() as soon as ctx is
+// cancelled or its deadline passes, eg to bound an HTTP request handler.
+func (h *couchbaseHeartBeater) LiveNodesContext(ctx context.Context) ([]string, error) {
+
+	nodeInfos, err := h.NodeInfosContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	liveNodes := []string{}
+	for _, nodeInfo := range nodeInfos {
+		liveNodes = append(liveNodes, nodeInfo.NodeUUID)
+	}
+	return liveNodes, nil
+
+}
+
+// Same as LiveNodes, but also returns the last-seen time and metadata from
+// each node's heartbeat doc, as a one-call snapshot of the cluster.
+func (h *couchbaseHeartBeater) NodeInfos() ([]NodeInfo, error) {
+	return h.NodeInfosContext(context.Background())
+}
+
+// Same as NodeInfos, but gives up and returns ctx.Err() as soon as ctx is
+// cancelled or its deadline passes.
+func (h *couchbaseHeartBeater) NodeInfosContext(ctx context.Context) ([]NodeInfo, error) {
+
+	var heartbeatDocs []heartbeatMeta
+	var aliveNodes map[string]bool
+	err := h.withContext(ctx, func() error {
+		var err error
+		docs, err := h.queryHeartbeatDocs(ctx)
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			// abandoned, don't bother looking up the timeout docs
+			return err
+		}
+		alive, err := h.heartbeatTimeoutDocsExist(ctx, docs)
+		if err != nil {
+			return err
+		}
+		heartbeatDocs, aliveNodes = docs, alive
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nodeInfos := []NodeInfo{}
+	for _, heartbeatDoc := range heartbeatDocs {
+		if h.isSelf(heartbeatDoc.NodeUUID) || heartbeatDoc.NodeUUID == "" {
+			continue
+		}
+		if aliveNodes[heartbeatDoc.NodeUUID] {
+			nodeInfos = append(nodeInfos, heartbeatDoc.nodeInfo())
+		}
+	}
+	return nodeInfos, nil
+
+}
+
+// Return every heartbeat doc, including this node's own and those of nodes
+// whose heartbeat timeout doc has expired, sorted by node uuid.  Meant for
+// debugging why a node is or isn't being found stale, it queries Couchbase
+// directly and doesn't change anything.
+func (h *couchbaseHeartBeater) AllHeartbeatRecords() ([]HeartbeatRecord, error) {
+
+	ctx := context.Background()
+	heartbeatDocs, err := h.queryHeartbeatDocs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	aliveNodes, err := h.heartbeatTimeoutDocsExist(ctx, heartbeatDocs)
+	if err != nil {
+		return nil, err
+	}
+	for _, heartbeatDoc := range heartbeatDocs {
+		if _, ok := aliveNodes[heartbeatDoc.NodeUUID]; ok || !h.isSelf(heartbeatDoc.NodeUUID) {
+			continue
+		}
+		// left out by heartbeatTimeoutDocsExist, since the checker never
+		// checks this node
+		alive, err := h.heartbeatTimeoutDocExists(ctx, heartbeatDoc.NodeUUID)
+		if err != nil {
+			return nil, err
+		}
+		aliveNodes[heartbeatDoc.NodeUUID] = alive
+	}
+
+	records := []HeartbeatRecord{}
+	for _, heartbeatDoc := range heartbeatDocs {
+		if heartbeatDoc.NodeUUID == "" {
+			continue
+		}
+		records = append(records, HeartbeatRecord{
+			NodeInfo:      heartbeatDoc.nodeInfo(),
+			Alive:         aliveNodes[heartbeatDoc.NodeUUID],
+			Self:          h.isSelf(heartbeatDoc.NodeUUID),
+			ReportedStale: h.isStale(heartbeatDoc.NodeUUID),
+		})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].NodeUUID < records[j].NodeUUID
+	})
+	return records, nil
+
+}
+
+// Delete the heartbeat docs of every other node whose heartbeat timeout doc
+// has expired, and return how many were deleted.  The checker already does
+// this as it reports stale nodes, but docs can be left behind by nodes that
+// died while no checker was running, or when running with WithKeepStaleDocs.
+// No handlers are called back.
+func (h *couchbaseHeartBeater) ReapStaleDocs() (int, error) {
+
+	ctx := context.Background()
+	heartbeatDocs, err := h.queryHeartbeatDocs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	aliveNodes, err := h.heartbeatTimeoutDocsExist(ctx, heartbeatDocs)
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	for _, heartbeatDoc := range heartbeatDocs {
+		if h.isSelf(heartbeatDoc.NodeUUID) || heartbeatDoc.NodeUUID == "" {
+			continue
+		}
+		if aliveNodes[heartbeatDoc.NodeUUID] {
+			continue
+		}
+		docId := h.heartbeatDocId(heartbeatDoc.NodeUUID)
+		err = h.trace(ctx, "cbheartbeat.Delete", docId, func(ctx context.Context) error {
+			return h.store.Delete(docId)
+		})
+		if err == ErrDocNotFound {
+			// a checker got there first
+			continue
+		}
+		if err != nil {
+			return reaped, err
+		}
+		reaped++
+	}
+	return reaped, nil
+
+}
+
+// Check whether a single node is alive, ie whether it has a heartbeat timeout
+// doc that has not yet expired.  This is a single doc lookup, so it is much
+// cheaper than LiveNodes when only one known node is of interest.
+func (h *couchbaseHeartBeater) IsNodeAlive(nodeUuid string) (bool, error) {
+	return h.IsNodeAliveContext(context.Background(), nodeUuid)
+}
+
+// Same as IsNodeAlive, but gives up and returns ctx.Err() as soon as ctx is
+// cancelled or its deadline passes.
+func (h *couchbaseHeartBeater) IsNodeAliveContext(ctx context.Context, nodeUuid string) (bool, error) {
+	alive := false
+	err := h.withContext(ctx, func() error {
+		exists, err := h.heartbeatTimeoutDocExists(ctx, nodeUuid)
+		if err != nil {
+			return err
+		}
+		alive = exists
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return alive, nil
+}
+
+// Run op, but return ctx.Err() as soon as ctx is done rather than waiting
+// for op, since Store operations don't take a context.  So the op is
+// abandoned rather than cancelled: the Store operation in progress carries
+// on in the background until the Store gives up on it, eg after the timeout
+// set by WithOperationTimeout.  The op should check ctx.Err() before each
+// further Store operation, so that once abandoned it doesn't start any
+// more, and should only set the caller's results once it has succeeded.
+func (h *couchbaseHeartBeater) withContext(ctx context.Context, op func() error) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		// can never be cancelled
+		return op()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+}
+
+// Find out which of the nodes with the given heartbeat docs are alive, ie
+// still have a heartbeat timeout doc.  Uses a single bulk get if the Store
+// supports it, rather than a round trip per node.
+func (h *couchbaseHeartBeater) heartbeatTimeoutDocsExist(ctx context.Context, heartbeatDocs []heartbeatMeta) (map[string]bool, error) {
+
+	aliveNodes := map[string]bool{}
+	if h.singleDoc {
+		// the heartbeat doc is its own timeout doc
+		now := h.clock.Now()
+		for _, heartbeatDoc := range heartbeatDocs {
+			aliveNodes[heartbeatDoc.NodeUUID] = !heartbeatDoc.expired(now)
+		}
+		return aliveNodes, nil
+	}
+	bulkStore, ok := h.store.(BulkStore)
+	if !ok {
+		for _, heartbeatDoc := range heartbeatDocs {
+			if h.isSelf(heartbeatDoc.NodeUUID) || heartbeatDoc.NodeUUID == "" {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			alive, err := h.heartbeatTimeoutDocExists(ctx, heartbeatDoc.NodeUUID)
+			if err != nil {
+				return nil, err
+			}
+			aliveNodes[heartbeatDoc.NodeUUID] = alive
+		}
+		return aliveNodes, nil
+	}
+
+	timeoutDocIds := []string{}
+	for _, heartbeatDoc := range heartbeatDocs {
+		if h.isSelf(heartbeatDoc.NodeUUID) || heartbeatDoc.NodeUUID == "" {
+			continue
+		}
+		timeoutDocIds = append(timeoutDocIds, h.heartbeatTimeoutDocId(heartbeatDoc.NodeUUID))
+	}
+	if len(timeoutDocIds) == 0 {
+		return aliveNodes, nil
+	}
+
+	timeoutDocs := map[string]json.RawMessage{}
+	err := h.trace(ctx, "cbheartbeat.GetBulk", "", func(ctx context.Context) error {
+		var err error
+		timeoutDocs, err = bulkStore.GetBulk(timeoutDocIds)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, heartbeatDoc := range heartbeatDocs {
+		_, alive := timeoutDocs[h.heartbeatTimeoutDocId(heartbeatDoc.NodeUUID)]
+		aliveNodes[heartbeatDoc.NodeUUID] = alive
+	}
+	return aliveNodes, nil
+
+}
+
+// Returns true if the heartbeat timeout doc for the given node exists, which
+// means that node has sent a heartbeat recently enough that it hasn't expired.
+func (h *couchbaseHeartBeater) heartbeatTimeoutDocExists(ctx context.Context, nodeUuid string) (bool, error) {
+
+	if h.singleDoc {
+		return h.singleDocAlive(ctx, nodeUuid)
+	}
+
+	timeoutDocId := h.heartbeatTimeoutDocId(nodeUuid)
+	// only its existence matters, and it may have been written by a DocCodec
+	var heartbeatTimeoutDoc json.RawMessage
+	err := h.trace(ctx, "cbheartbeat.Get", timeoutDocId, func(ctx context.Context) error {
+		return h.store.Get(timeoutDocId, &heartbeatTimeoutDoc)
+	})
+	if err != nil {
+		if err == ErrDocNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+
+}
+
+// The uuids of the nodes which the checker has reported as stale, and which
+// haven't sent a heartbeat since, sorted.  Together with LiveNodes this gives
+// the current picture of the cluster, rather than just the stale events.
+func (h *couchbaseHeartBeater) StaleNodes() []string {
+	h.staleNodesMutex.Lock()
+	defer h.staleNodesMutex.Unlock()
+	staleNodes := make([]string, 0, len(h.staleNodes))
+	for nodeUuid := range h.staleNodes {
+		staleNodes = append(staleNodes, nodeUuid)
+	}
+	sort.Strings(staleNodes)
+	return staleNodes
+}
+
+func (h *couchbaseHeartBeater) markStale(nodeUuid string) {
+	h.staleNodesMutex.Lock()
+	defer h.staleNodesMutex.Unlock()
+	h.staleNodes[nodeUuid] = struct{}{}
+}
+
+func (h *couchbaseHeartBeater) isStale(nodeUuid string) bool {
+	h.staleNodesMutex.Lock()
+	defer h.staleNodesMutex.Unlock()
+	_, stale := h.staleNodes[nodeUuid]
+	return stale
+}
+
+// Remove the node from the stale set, and return whether it was in it
+func (h *couchbaseHeartBeater) clearStale(nodeUuid string) bool {
+	h.staleNodesMutex.Lock()
+	defer h.staleNodesMutex.Unlock()
+	_, wasStale := h.staleNodes[nodeUuid]
+	delete(h.staleNodes, nodeUuid)
+	return wasStale
+}
+
+// A channel which receives the uuid of every node the heartbeat checker
+// detects as stale, as an alternative to (or in addition to) passing in a
+// HeartbeatsStoppedHandler.  The channel is buffered, and if the consumer
+// falls behind so that the buffer is full, events are dropped rather than
+// blocking the checker.
+func (h *couchbaseHeartBeater) StaleEvents() <-chan string {
+	return h.staleEvents
+}
+
+func (h *couchbaseHeartBeater) sendStaleEvent(nodeUuid string) {
+	select {
+	case h.staleEvents <- nodeUuid:
+	default:
+		h.logger.Printf("Stale events channel full, dropping event for node: %v", nodeUuid)
+	}
+}
+
+// A channel which receives every error hit by the sender and checker
+// goroutines, as a *HeartbeatError tagged with the operation that failed, so
+// that callers can alert, restart or ignore as they see fit.  The errors are
+// still logged as well.  Like StaleEvents, the channel is buffered, and
+// errors are dropped rather than blocking the heartbeat loops if it is full.
+func (h *couchbaseHeartBeater) Errors() <-chan error {
+	return h.errors
+}
+
+func (h *couchbaseHeartBeater) sendError(op Operation, nodeUuid string, err error) {
+	select {
+	case h.errors <- &HeartbeatError{Op: op, NodeUUID: nodeUuid, Err: err}:
+	default:
+		// already logged, so just drop it
+	}
+}
+
+// Is this this node's own heartbeat doc?  Observers have no heartbeat doc
+// of their own, so they see every node.
+func (h *couchbaseHeartBeater) isSelf(nodeUuid string) bool {
+	return !h.observer && nodeUuid == h.nodeUuid
+}
+
+func (h *couchbaseHeartBeater) heartbeatTimeoutDocId(nodeUuid string) string {
+	return h.docId(DocKindHeartbeatTimeout, nodeUuid)
+}
+
+func (h *couchbaseHeartBeater) heartbeatStaleDocId(nodeUuid string) string {
+	return h.docId(DocKindHeartbeatStale, nodeUuid)
+}
+
+func (h *couchbaseHeartBeater) heartbeatDocId(nodeUuid string) string {
+	return h.docId(DocKindHeartbeat, nodeUuid)
+}
+
+// The prefix shared by the ids of every node's heartbeat doc, which the view
+// or N1QL query is limited to.  With WithDocIdFunc there may not be one, so
+// the query relies on the doc type alone.
+func (h *couchbaseHeartBeater) heartbeatDocIdPrefix() string {
+	if h.docIdFunc != nil {
+		return ""
+	}
+	return h.heartbeatDocId("")
+}
+
+// The id of the doc of the given kind for the given node, which is
+// <keyPrefix><kind>:<nodeUuid> with the nodeUuid escaped by escapeNodeUuid,
+// unless running with WithDocIdFunc.  The escaped nodeUuid never contains
+// ":", so it is always whatever follows the last ":" of the id.  So nodes
+// sharing a keyPrefix never share an id, even if their nodeUuids or the
+// keyPrefix contain ":", and nor do docs of different kinds, since the kinds
+// all end differently.  A DocIdFunc is passed the nodeUuid as is, and is
+// responsible for keeping its own ids apart.
+func (h *couchbaseHeartBeater) docId(kind, nodeUuid string) string {
+	if h.docIdFunc != nil {
+		return h.docIdFunc(kind, nodeUuid)
+	}
+	return fmt.Sprintf("%v%v:%v", h.keyPrefix, kind, escapeNodeUuid(nodeUuid))
+}
+
+// Percent-encode the bytes of a nodeUuid which would make a doc id ambiguous
+// or awkward to handle, ie the ":" separator, whitespace and "%" itself, so
+// that distinct nodeUuids always escape differently.  U+10FFFF is escaped
+// too, since doc ids starting with it would sort after docIdRangeEnd.  Anything else is left
+// alone, so nodeUuids without any of these keep the ids they always had.
+func escapeNodeUuid(nodeUuid string) string {
+
+	if strings.IndexFunc(nodeUuid, needsEscaping) < 0 {
+		return nodeUuid
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(nodeUuid); {
+		r, size := utf8.DecodeRuneInString(nodeUuid[i:])
+		if needsEscaping(r) && !(r == utf8.RuneError && size == 1) {
+			for _, b := range []byte(nodeUuid[i : i+size]) {
+				fmt.Fprintf(&escaped, "%%%02X", b)
+			}
+		} else {
+			escaped.WriteString(nodeUuid[i : i+size])
+		}
+		i += size
+	}
+	return escaped.String()
+
+}
+
+func needsEscaping(r rune) bool {
+	return r == ':' || r == '%' || r == unicode.MaxRune || unicode.IsSpace(r)
+}
+
+func isControlNotSpace(r rune) bool {
+	return unicode.IsControl(r) && !unicode.IsSpace(r)
+}
+
+// Query the heartbeat view directly and return its rows, including this
+// node's own, eg for tooling which needs more than LiveNodes or NodeInfos.
+// NodeUUID is taken from each doc, with the codec set by WithDocCodec if
+// any.  Returns ErrNoView if heartbeat docs aren't found with a view, eg
+// with WithN1QL or a Store which isn't a ViewStore.
+func (h *couchbaseHeartBeater) QueryHeartbeatView() ([]HeartbeatViewRow, error) {
+
+	viewStore, ok := h.store.(ViewStore)
+	if !ok {
+		return nil, ErrNoView
+	}
+	var rows []HeartbeatViewRow
+	err := h.trace(context.Background(), "cbheartbeat.QueryHeartbeatView", "", func(ctx context.Context) error {
+		var err error
+		rows, err = viewStore.QueryHeartbeatView(h.heartbeatDocIdPrefix())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		if heartbeatDoc, err := h.decodeHeartbeatDoc(rows[i].Value); err == nil {
+			rows[i].NodeUUID = heartbeatDoc.NodeUUID
+		}
+	}
+	return rows, nil
+
+}
+
+// Get all heartbeat docs from the store
+func (h *couchbaseHeartBeater) queryHeartbeatDocs(ctx context.Context) ([]heartbeatMeta, error) {
+
+	rawDocs := []json.RawMessage{}
+	err := h.trace(ctx, "cbheartbeat.QueryHeartbeatDocs", "", func(ctx context.Context) error {
+		var err error
+		rawDocs, err = h.store.QueryHeartbeatDocs(h.heartbeatDocType, h.heartbeatDocIdPrefix())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeats := []heartbeatMeta{}
+	for _, rawDoc := range rawDocs {
+		heartbeat, err := h.decodeHeartbeatDoc(rawDoc)
+		if err != nil {
+			h.logger.Printf("Skipping heartbeat doc that can't be parsed: %s err: %v", rawDoc, err)
+			continue
+		}
+		heartbeat.Type = h.heartbeatDocType
+		heartbeats = append(heartbeats, heartbeat)
+	}
+
+	return heartbeats, nil
+
+}
+
+func (h *couchbaseHeartBeater) sendHeartbeat(ctx context.Context, interval time.Duration) error {
+
+	if touchStore, ok := h.canTouch(interval); ok {
+		err := h.touchHeartbeatDocs(ctx, touchStore, interval)
+		if err != ErrDocNotFound {
+			return err
+		}
+		// the timeout doc expired, or a checker which saw it expired has
+		// deleted the heartbeat doc, so rewrite them both
+	}
+
+	if h.singleDoc {
+		if err := h.upsertHeartbeatDoc(ctx, interval); err != nil {
+			return err
+		}
+		h.recordFullWrite(interval)
+		return nil
+	}
+
+	if bulkStore, ok := h.store.(BulkWriteStore); ok && h.durability == DurabilityNone {
+		if err := h.upsertHeartbeatDocsBulk(ctx, bulkStore, interval); err != nil {
+			return err
+		}
+		h.recordFullWrite(interval)
+		return nil
+	}
+
+	if err := h.upsertHeartbeatDoc(ctx, interval); err != nil {
+		return err
+	}
+	if err := h.upsertHeartbeatTimeoutDoc(ctx, interval); err != nil {
+		return err
+	}
+	h.recordFullWrite(interval)
+	return nil
+}
+
+// Write the heartbeat doc and timeout doc together, in one round trip.  If
+// only one of them is written, only the other is retried.
+func (h *couchbaseHeartBeater) upsertHeartbeatDocsBulk(ctx context.Context, bulkStore BulkWriteStore, interval time.Duration) error {
+
+	heartbeatDoc, err := h.encodeHeartbeatDoc(h.newHeartbeatDoc(interval))
+	if err != nil {
+		return err
+	}
+	heartbeatTimeoutDoc, err := h.encodeTimeoutDoc(h.newHeartbeatTimeoutDoc())
+	if err != nil {
+		return err
+	}
+
+	pending := []BulkWrite{
+		{
+			DocId: h.heartbeatDocId(h.nodeUuid),
+			Doc:   heartbeatDoc,
+			TTL:   h.heartbeatDocTTLFor(interval),
+		},
+		{
+			DocId: h.heartbeatTimeoutDocId(h.nodeUuid),
+			Doc:   heartbeatTimeoutDoc,
+			TTL:   h.timeoutTTL(interval),
+		},
+	}
+
+	return h.withRetry(ctx, func() error {
+		return h.trace(ctx, "cbheartbeat.UpsertBulk", "", func(ctx context.Context) error {
+			errs := bulkStore.UpsertBulk(pending)
+			failed := []BulkWrite{}
+			var firstErr error
+			for i, err := range errs {
+				if err == nil {
+					continue
+				}
+				failed = append(failed, pending[i])
+				if firstErr == nil {
+					// unwrapped, so that withRetry can tell if it's worth retrying
+					firstErr = err
+				}
+			}
+			pending = failed
+			return firstErr
+		})
+	})
+
+}
+
+// When running with WithMinimalWrites, whether the heartbeat doc can be left
+// alone and only the timeout doc's expiry refreshed.  The heartbeat doc has
+// to be rewritten whenever its contents change, and well before it expires.
+func (h *couchbaseHeartBeater) canTouch(interval time.Duration) (TouchStore, bool) {
+
+	if !h.minimalWrites || h.durability != DurabilityNone || h.singleDoc {
+		return nil, false
+	}
+	touchStore, ok := h.store.(TouchStore)
+	if !ok {
+		return nil, false
+	}
+
+	h.metadataMutex.Lock()
+	defer h.metadataMutex.Unlock()
+	if h.heartbeatDocDirty || h.heartbeatDocWritten.IsZero() || h.heartbeatDocInterval != interval {
+		return nil, false
+	}
+	if ttl := h.heartbeatDocTTLFor(interval); ttl > 0 && h.clock.Now().Sub(h.heartbeatDocWritten) >= ttl/2 {
+		return nil, false
+	}
+	return touchStore, true
+
+}
+
+func (h *couchbaseHeartBeater) recordFullWrite(interval time.Duration) {
+	h.metadataMutex.Lock()
+	defer h.metadataMutex.Unlock()
+	h.heartbeatDocDirty = false
+	h.heartbeatDocWritten = h.clock.Now()
+	h.heartbeatDocInterval = interval
+}
+
+// Reset the expiry of both docs rather than rewriting them, when running with
+// WithMinimalWrites.  A successful touch of the timeout doc doesn't mean the
+// heartbeat doc is still there, since a checker which saw the timeout doc
+// expired may delete the heartbeat doc even after this node has rewritten
+// both, so the heartbeat doc is touched too, to find out.  Returns
+// ErrDocNotFound if either is missing.
+func (h *couchbaseHeartBeater) touchHeartbeatDocs(ctx context.Context, touchStore TouchStore, interval time.Duration) error {
+	if err := h.touchDoc(ctx, touchStore, h.heartbeatTimeoutDocId(h.nodeUuid), h.timeoutTTL(interval)); err != nil {
+		return err
+	}
+	return h.touchDoc(ctx, touchStore, h.heartbeatDocId(h.nodeUuid), h.heartbeatDocTTLFor(interval))
+}
+
+func (h *couchbaseHeartBeater) touchDoc(ctx context.Context, touchStore TouchStore, docId string, ttl time.Duration) error {
+	return h.withRetry(ctx, func() error {
+		return h.trace(ctx, "cbheartbeat.Touch", docId, func(ctx context.Context) error {
+			return touchStore.Touch(docId, ttl)
+		})
+	})
+}
+
+// The next heartbeat doc to write, with the next sequence number
+func (h *couchbaseHeartBeater) newHeartbeatDoc(interval time.Duration) heartbeatMeta {
+	return heartbeatMeta{
+		Type:      h.heartbeatDocType,
+		NodeUUID:  h.nodeUuid,
+		Timestamp: h.clock.Now().UnixNano() / int64(time.Millisecond),
+		Sequence:  atomic.AddUint64(&h.sequence, 1),
+		TimeoutMs: int64(h.timeoutTTL(interval) / time.Millisecond),
+		Metadata:  h.getMetadata(),
+		Minimal:   h.minimalWrites && !h.singleDoc,
+	}
+}
+
+func (h *couchbaseHeartBeater) newHeartbeatTimeoutDoc() heartbeatTimeout {
+	return heartbeatTimeout{
+		Type:     h.timeoutDocType,
+		NodeUUID: h.nodeUuid,
+	}
+}
+
+func (h *couchbaseHeartBeater) upsertHeartbeatDoc(ctx context.Context, interval time.Duration) error {
+
+	heartbeatDoc, err := h.encodeHeartbeatDoc(h.newHeartbeatDoc(interval))
+	if err != nil {
+		return err
+	}
+	docId := h.heartbeatDocId(h.nodeUuid)
+
+	// unlike the timeout doc, this normally gets deleted by a checker when
+	// the node goes stale, but expire it eventually in case no checker does
+	ttl := h.heartbeatDocTTLFor(interval)
+
+	err = h.withRetry(ctx, func() error {
+		return h.trace(ctx, "cbheartbeat.Upsert", docId, func(ctx context.Context) error {
+			if h.singleDoc {
+				// also serves as the timeout doc
+				return h.upsertDurable(docId, heartbeatDoc, ttl)
+			}
+			return h.store.Upsert(docId, heartbeatDoc, ttl)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+
+}
+
+func (h *couchbaseHeartBeater) upsertHeartbeatTimeoutDoc(ctx context.Context, interval time.Duration) error {
+
+	heartbeatTimeoutDoc, err := h.encodeTimeoutDoc(h.newHeartbeatTimeoutDoc())
+	if err != nil {
+		return err
+	}
+	docId := h.heartbeatTimeoutDocId(h.nodeUuid)
+
+	// make the expire time a multiple of the interval time (double by default),
+	// to ensure there is always a heartbeat timeout document present under
+	// normal operation
+	ttl := h.timeoutTTL(interval)
+
+	err = h.withRetry(ctx, func() error {
+		return h.trace(ctx, "cbheartbeat.Upsert", docId, func(ctx context.Context) error {
+			return h.upsertDurable(docId, heartbeatTimeoutDoc, ttl)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+
+}
+
+// Write the doc with the durability asked for with WithDurability
+func (h *couchbaseHeartBeater) upsertDurable(docId string, doc interface{}, ttl time.Duration) error {
+	if h.durability == DurabilityNone {
+		return h.store.Upsert(docId, doc, ttl)
+	}
+	durableStore, ok := h.store.(DurableStore)
+	if !ok {
+		return fmt.Errorf("Store does not support durable writes: %T", h.store)
+	}
+	return durableStore.UpsertDurable(docId, doc, ttl, h.durability)
+}
+
+// How long the heartbeat doc should live when sending at the given interval
+func (h *couchbaseHeartBeater) heartbeatDocTTLFor(interval time.Duration) time.Duration {
+	if h.singleDoc {
+		return h.timeoutTTL(interval)
+	}
+	if h.heartbeatDocTTL <= 0 {
+		return 0
+	}
+	if minTTL := h.timeoutTTL(interval) * minHeartbeatDocTTLMultiplier; h.heartbeatDocTTL < minTTL {
+		return minTTL
+	}
+	return h.heartbeatDocTTL
+}
 
+// How long the heartbeat timeout doc should live when sending at the given interval
+func (h *couchbaseHeartBeater) timeoutTTL(interval time.Duration) time.Duration {
+	return time.Duration(float64(interval)*h.timeoutMultiplier) + h.timeoutGracePeriod
 }
@@ -0,0 +1,50 @@
+package cbheartbeat
+
+import (
+	"testing"
+)
+
+func TestEscapeNodeUuid(t *testing.T) {
+	for nodeUuid, want := range map[string]string{
+		"":                  "",
+		"a":                 "a",
+		"10.0.0.1:8091":     "10.0.0.1%3A8091",
+		"[::1]:8091":        "[%3A%3A1]%3A8091",
+		"a%3Ab":             "a%253Ab",
+		"node a":            "node%20a",
+		"node\u00a0a":       "node%C2%A0a",
+		"ノード":               "ノード",
+		"\U0010ffffa":       "%F4%8F%BF%BFa",
+		"heartbeat_timeout": "heartbeat_timeout",
+	} {
+		if got := escapeNodeUuid(nodeUuid); got != want {
+			t.Errorf("escapeNodeUuid(%q) = %q, want %q", nodeUuid, got, want)
+		}
+	}
+}
+
+// nodeUuids which would give the same doc ids if they weren't escaped, eg
+// "a:b" and "a%3Ab", or a node's heartbeat doc and another node's timeout
+// doc
+func TestDocIdsDontCollide(t *testing.T) {
+
+	nodeUuids := []string{"a", "b", "a:b", "a%3Ab", "a b", "a%20b", "timeout:a", "_timeout:a", ":a", "a:"}
+	for _, keyPrefix := range []string{"", "app:", "app:heartbeat:"} {
+		docIds := map[string]string{}
+		for _, nodeUuid := range nodeUuids {
+			h, err := newHeartbeater(nil, newCouchbaseStore("", ""), []Option{WithKeyPrefix(keyPrefix), WithNodeUUID(nodeUuid)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, kind := range []string{DocKindHeartbeat, DocKindHeartbeatTimeout, DocKindHeartbeatStale, DocKindLeader} {
+				docId := h.docId(kind, nodeUuid)
+				doc := kind + " doc of " + nodeUuid
+				if other, ok := docIds[docId]; ok {
+					t.Errorf("with key prefix %q, the %v and the %v both have id %q", keyPrefix, other, doc, docId)
+				}
+				docIds[docId] = doc
+			}
+		}
+	}
+
+}
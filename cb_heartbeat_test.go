@@ -0,0 +1,900 @@
+package cbheartbeat_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+	"github.com/tleyden/cb-heartbeat/cbheartbeattest"
+)
+
+// Several heartbeaters sharing a MemoryStore and a FakeClock, as if they
+// were nodes sharing a bucket
+type cluster struct {
+	t     testing.TB
+	clock *cbheartbeattest.FakeClock
+	store *cbheartbeattest.MemoryStore
+}
+
+func newCluster(t testing.TB) *cluster {
+	clock := cbheartbeattest.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	return &cluster{
+		t:     t,
+		clock: clock,
+		store: cbheartbeattest.NewMemoryStore(clock),
+	}
+}
+
+// A heartbeater for the given node, which is closed when the test ends
+func (c *cluster) heartbeater(nodeUuid string, opts ...cbheartbeat.Option) cbheartbeat.Heartbeater {
+	c.t.Helper()
+	return c.heartbeaterWithStore(c.store, nodeUuid, opts...)
+}
+
+// Same as heartbeater, but for a store which wraps the cluster's store
+func (c *cluster) heartbeaterWithStore(store cbheartbeat.Store, nodeUuid string, opts ...cbheartbeat.Option) cbheartbeat.Heartbeater {
+	c.t.Helper()
+	opts = append([]cbheartbeat.Option{
+		cbheartbeat.WithNodeUUID(nodeUuid),
+		cbheartbeat.WithClock(c.clock),
+		cbheartbeat.WithLogger(discardLogger{}),
+	}, opts...)
+	heartbeater, err := cbheartbeat.NewHeartbeaterWithStore(store, opts...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.t.Cleanup(func() { heartbeater.Close() })
+	return heartbeater
+}
+
+// Wait for something the sender or checker goroutine does after the clock
+// is advanced, since they run concurrently with the test
+func waitFor(t testing.TB, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, args ...interface{}) {}
+
+func TestStopTwice(t *testing.T) {
+
+	c := newCluster(t)
+	h := c.heartbeater("a")
+	if err := h.StartSendingHeartbeatsContext(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.StartCheckingHeartbeatsContext(context.Background(), time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	h.StopSendingHeartbeats()
+	h.StopSendingHeartbeats()
+	h.StopCheckingHeartbeats()
+	h.StopCheckingHeartbeats()
+	h.Stop()
+	h.Wait()
+
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	h := newCluster(t).heartbeater("a")
+	h.StopSendingHeartbeats()
+	h.StopCheckingHeartbeats()
+	h.Stop()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Cancelling the context stops the sender and checker, and stopping them
+// explicitly afterwards is harmless
+func TestCancelContext(t *testing.T) {
+
+	c := newCluster(t)
+	h := c.heartbeater("a")
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := h.StartSendingHeartbeatsContext(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.StartCheckingHeartbeatsContext(ctx, 2*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	h.Wait()
+
+	upserts, queries := c.store.Ops(cbheartbeattest.OpUpsert), c.store.Ops(cbheartbeattest.OpQuery)
+	c.clock.Advance(10 * time.Second)
+	if got := c.store.Ops(cbheartbeattest.OpUpsert); got != upserts {
+		t.Errorf("%v upserts after cancelling, want none", got-upserts)
+	}
+	if got := c.store.Ops(cbheartbeattest.OpQuery); got != queries {
+		t.Errorf("%v queries after cancelling, want none", got-queries)
+	}
+	h.StopSendingHeartbeats()
+	h.StopCheckingHeartbeats()
+
+}
+
+func timeoutDocId(nodeUuid string) string {
+	return cbheartbeat.DocKindHeartbeatTimeout + ":" + nodeUuid
+}
+
+// A sub-second interval must not give the timeout doc a zero TTL, which
+// would mean it never expires
+func TestSubSecondIntervalTimeoutTTL(t *testing.T) {
+	c := newCluster(t)
+	h := c.heartbeater("a")
+	if err := h.StartSendingHeartbeatsContext(context.Background(), 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	ttl, ok := c.store.TTL(timeoutDocId("a"))
+	if !ok || ttl != 600*time.Millisecond {
+		t.Fatalf("timeout doc ttl %v (exists %v), want 600ms", ttl, ok)
+	}
+}
+
+// Write one heartbeat for the node, as if it sent heartbeats at the given
+// interval and then died
+func sendOnce(t testing.TB, h cbheartbeat.Heartbeater, interval time.Duration) {
+	t.Helper()
+	if err := h.StartSendingHeartbeatsContext(context.Background(), interval); err != nil {
+		t.Fatal(err)
+	}
+	h.StopSendingHeartbeats()
+	h.Wait()
+}
+
+// A checker which is started but never ticks by itself, since its interval
+// is longer than any test advances the clock, so checks run when RunCheck is
+// called
+func startChecker(t testing.TB, h cbheartbeat.Heartbeater, handler cbheartbeat.HeartbeatsStoppedHandler) {
+	t.Helper()
+	if err := h.StartCheckingHeartbeatsContext(context.Background(), time.Hour, handler); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runCheck(t testing.TB, h cbheartbeat.Heartbeater) cbheartbeat.CheckResult {
+	t.Helper()
+	result, err := h.RunCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// Events that don't fit in the buffer are dropped rather than blocking the
+// checker
+func TestStaleEvents(t *testing.T) {
+
+	c := newCluster(t)
+	checker := c.heartbeater("checker", cbheartbeat.WithStaleEventsBufferSize(2))
+	startChecker(t, checker, nil)
+	for _, nodeUuid := range []string{"a", "b", "c"} {
+		sendOnce(t, c.heartbeater(nodeUuid), time.Second)
+	}
+	c.clock.Advance(2 * time.Second)
+
+	if result := runCheck(t, checker); result.StaleNodes != 3 {
+		t.Fatalf("RunCheck found %v stale nodes, want 3", result.StaleNodes)
+	}
+	if staleNodes := drain(checker.StaleEvents()); !reflect.DeepEqual(staleNodes, []string{"a", "b"}) {
+		t.Fatalf("StaleEvents gave %v, want [a b]", staleNodes)
+	}
+
+}
+
+// Receive whatever is buffered in the channel
+func drain(events <-chan string) []string {
+	received := []string{}
+	for {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		default:
+			return received
+		}
+	}
+}
+
+// Make the store fail the next n calls of the operation with err
+func failNext(store *cbheartbeattest.MemoryStore, op string, n int, err error) {
+	var mutex sync.Mutex
+	store.SetFailure(func(failedOp, docId string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failedOp != op || n == 0 {
+			return nil
+		}
+		n--
+		return err
+	})
+}
+
+// A net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSendRetriesTransientErrors(t *testing.T) {
+	for _, err := range []error{
+		io.EOF,
+		fmt.Errorf("writing heartbeat: %w", io.ErrUnexpectedEOF),
+		fmt.Errorf("writing heartbeat: %w", timeoutError{}),
+	} {
+		c := newCluster(t)
+		clock := newTimerClock(c.clock)
+		h := c.heartbeater("a", cbheartbeat.WithClock(clock), cbheartbeat.WithSendRetries(2, time.Millisecond))
+		failNext(c.store, cbheartbeattest.OpUpsert, 2, err)
+		started := make(chan error, 1)
+		go func() {
+			started <- h.StartSendingHeartbeatsContext(context.Background(), time.Second)
+		}()
+		// the retries back off by the clock
+		for _, delay := range []time.Duration{time.Millisecond, 2 * time.Millisecond} {
+			if d := nextTimer(t, clock); d != delay {
+				t.Fatalf("retry after %v, want %v", d, delay)
+			}
+			c.clock.Advance(delay)
+		}
+		if err := <-started; err != nil {
+			t.Fatal(err)
+		}
+		h.StopSendingHeartbeats()
+		h.Wait()
+		if _, lastErr := h.SenderHealth(); lastErr != nil {
+			t.Fatalf("heartbeat failed despite retries after %v: %v", err, lastErr)
+		}
+		// the heartbeat doc three times, then the timeout doc
+		if upserts := c.store.Ops(cbheartbeattest.OpUpsert); upserts != 4 {
+			t.Fatalf("%v upserts after failing twice with %v, want 4", upserts, err)
+		}
+	}
+}
+
+// Stopping the sender ends a wait to retry, rather than the heartbeat
+// carrying on in the background
+func TestStopEndsRetryWait(t *testing.T) {
+	c := newCluster(t)
+	clock := newTimerClock(c.clock)
+	h := c.heartbeater("a", cbheartbeat.WithClock(clock), cbheartbeat.WithSendRetries(2, time.Hour))
+	failNext(c.store, cbheartbeattest.OpUpsert, 1, io.EOF)
+	started := make(chan error, 1)
+	go func() {
+		started <- h.StartSendingHeartbeatsContext(context.Background(), time.Second)
+	}()
+	nextTimer(t, clock)
+	h.StopSendingHeartbeats()
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	h.Wait()
+	if upserts := c.store.Ops(cbheartbeattest.OpUpsert); upserts != 1 {
+		t.Fatalf("%v upserts, want just the one that failed", upserts)
+	}
+}
+
+func TestSendFailsFastOnOtherErrors(t *testing.T) {
+	c := newCluster(t)
+	h := c.heartbeater("a", cbheartbeat.WithSendRetries(2, time.Millisecond))
+	failNext(c.store, cbheartbeattest.OpUpsert, 1, errors.New("auth failed"))
+	sendOnce(t, h, time.Second)
+	if _, lastErr := h.SenderHealth(); lastErr == nil {
+		t.Fatal("heartbeat succeeded, want the auth error")
+	}
+	if upserts := c.store.Ops(cbheartbeattest.OpUpsert); upserts != 1 {
+		t.Fatalf("%v upserts, want 1", upserts)
+	}
+}
+
+// Run with -race: the sender, the checker and callers share the store and
+// the heartbeater's state
+func TestConcurrentSenderCheckerAndQueries(t *testing.T) {
+
+	c := newCluster(t)
+	h := c.heartbeater("a")
+	if err := h.Start(time.Second, 2*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := h.LiveNodes(); err != nil {
+					t.Error(err)
+					return
+				}
+				h.StaleNodes()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		c.clock.Advance(time.Second)
+	}
+	wg.Wait()
+	h.Stop()
+	h.Wait()
+
+}
+
+// A FakeClock which reports the duration of every timer it starts, once the
+// timer is set, so that a test can wait for the sender to schedule its next
+// heartbeat before advancing the clock
+type timerClock struct {
+	*cbheartbeattest.FakeClock
+	timers chan time.Duration
+}
+
+func newTimerClock(clock *cbheartbeattest.FakeClock) timerClock {
+	return timerClock{clock, make(chan time.Duration, 100)}
+}
+
+func (c timerClock) NewTimer(d time.Duration) cbheartbeat.Timer {
+	timer := c.FakeClock.NewTimer(d)
+	c.timers <- d
+	return reportingTimer{timer, c.timers}
+}
+
+type reportingTimer struct {
+	cbheartbeat.Timer
+	timers chan time.Duration
+}
+
+func (t reportingTimer) Reset(d time.Duration) bool {
+	active := t.Timer.Reset(d)
+	t.timers <- d
+	return active
+}
+
+// Wait for the next timer to be set, and return its duration
+func nextTimer(t testing.TB, clock timerClock) time.Duration {
+	t.Helper()
+	select {
+	case d := <-clock.timers:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a timer")
+		return 0
+	}
+}
+
+func TestSetSendInterval(t *testing.T) {
+
+	c := newCluster(t)
+	clock := newTimerClock(c.clock)
+	h := c.heartbeater("a", cbheartbeat.WithClock(clock))
+	if err := h.StartSendingHeartbeatsContext(context.Background(), 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := nextTimer(t, clock); d != 10*time.Second {
+		t.Fatalf("first heartbeat scheduled after %v, want 10s", d)
+	}
+
+	if err := h.SetSendInterval(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the heartbeat already scheduled still happens
+	c.clock.Advance(10 * time.Second)
+	if d := nextTimer(t, clock); d != time.Second {
+		t.Fatalf("next heartbeat scheduled after %v, want 1s", d)
+	}
+	if ttl, _ := c.store.TTL(timeoutDocId("a")); ttl != 2*time.Second {
+		t.Fatalf("timeout doc ttl %v, want 2s", ttl)
+	}
+	upserts := c.store.Ops(cbheartbeattest.OpUpsert)
+	c.clock.Advance(time.Second)
+	if d := nextTimer(t, clock); d != time.Second {
+		t.Fatalf("next heartbeat scheduled after %v, want 1s", d)
+	}
+	if got := c.store.Ops(cbheartbeattest.OpUpsert); got != upserts+2 {
+		t.Fatalf("%v upserts 1s later, want %v", got, upserts+2)
+	}
+
+	if err := h.SetSendInterval(0); err == nil {
+		t.Fatal("SetSendInterval(0) succeeded")
+	}
+
+}
+
+func TestStaleAfterMissedChecks(t *testing.T) {
+
+	c := newCluster(t)
+	handler := &recordingHandler{}
+	checker := c.heartbeater("checker", cbheartbeat.WithStaleAfterMissedChecks(2))
+	startChecker(t, checker, handler)
+	a := c.heartbeater("a")
+	b := c.heartbeater("b")
+	sendOnce(t, a, time.Second)
+	sendOnce(t, b, time.Second)
+
+	// both miss a check, then only b comes back before the next one
+	c.clock.Advance(2 * time.Second)
+	runCheck(t, checker)
+	if len(handler.stale) != 0 {
+		t.Fatalf("stale after one missed check: %v", handler.stale)
+	}
+	sendOnce(t, b, time.Second)
+	runCheck(t, checker)
+	if !reflect.DeepEqual(handler.stale, []string{"a"}) {
+		t.Fatalf("stale = %v after a missed two checks, want [a]", handler.stale)
+	}
+
+	// b's count started again when it came back
+	c.clock.Advance(2 * time.Second)
+	runCheck(t, checker)
+	if !reflect.DeepEqual(handler.stale, []string{"a"}) {
+		t.Fatalf("stale = %v after b missed one check since coming back, want [a]", handler.stale)
+	}
+	runCheck(t, checker)
+	if !reflect.DeepEqual(handler.stale, []string{"a", "b"}) {
+		t.Fatalf("stale = %v, want [a b]", handler.stale)
+	}
+
+}
+
+// Records every callback, in order
+type recordingHandler struct {
+	mutex    sync.Mutex
+	stale    []string
+	rejoined []string
+}
+
+func (r *recordingHandler) StaleHeartBeatDetected(nodeUuid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stale = append(r.stale, nodeUuid)
+}
+
+func (r *recordingHandler) NodeRejoined(nodeUuid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rejoined = append(r.rejoined, nodeUuid)
+}
+
+func TestFirstHeartbeatWrittenBeforeStartReturns(t *testing.T) {
+	c := newCluster(t)
+	h := c.heartbeater("a")
+	if err := h.StartSendingHeartbeatsContext(context.Background(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if docIds := c.store.DocIds(); !reflect.DeepEqual(docIds, []string{cbheartbeat.DocKindHeartbeat + ":a", timeoutDocId("a")}) {
+		t.Fatalf("docs %v straight after starting, want the heartbeat and timeout docs", docIds)
+	}
+	if liveNodes, err := c.heartbeater("b").LiveNodes(); err != nil || !reflect.DeepEqual(liveNodes, []string{"a"}) {
+		t.Fatalf("LiveNodes = %v, %v, want [a]", liveNodes, err)
+	}
+}
+
+func TestNoWritesAfterWait(t *testing.T) {
+
+	c := newCluster(t)
+	clock := newTimerClock(c.clock)
+	h := c.heartbeater("a", cbheartbeat.WithClock(clock))
+	if err := h.Start(time.Second, 2*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	nextTimer(t, clock)
+	c.clock.Advance(time.Second)
+	nextTimer(t, clock)
+
+	h.Stop()
+	h.Wait()
+	upserts, queries := c.store.Ops(cbheartbeattest.OpUpsert), c.store.Ops(cbheartbeattest.OpQuery)
+	for i := 0; i < 10; i++ {
+		c.clock.Advance(time.Second)
+	}
+	if got := c.store.Ops(cbheartbeattest.OpUpsert); got != upserts {
+		t.Fatalf("%v upserts after Wait returned, want %v", got, upserts)
+	}
+	if got := c.store.Ops(cbheartbeattest.OpQuery); got != queries {
+		t.Fatalf("%v queries after Wait returned, want %v", got, queries)
+	}
+
+}
+
+// Panics on the first node it's told about, and records the rest
+type panickingHandler struct {
+	recordingHandler
+	panicked bool
+}
+
+func (p *panickingHandler) StaleHeartBeatDetected(nodeUuid string) {
+	if !p.panicked {
+		p.panicked = true
+		panic("handler bug")
+	}
+	p.recordingHandler.StaleHeartBeatDetected(nodeUuid)
+}
+
+func (p *panickingHandler) staleNodes() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string{}, p.stale...)
+}
+
+// A panicking handler is logged, and the checker carries on
+func TestCheckerSurvivesPanickingHandler(t *testing.T) {
+
+	c := newCluster(t)
+	handler := &panickingHandler{}
+	logger := &recordingLogger{}
+	checker := c.heartbeater("checker", cbheartbeat.WithLogger(logger))
+	if err := checker.StartCheckingHeartbeatsContext(context.Background(), 2*time.Second, handler); err != nil {
+		t.Fatal(err)
+	}
+	sendOnce(t, c.heartbeater("a"), time.Second)
+	c.clock.Advance(2 * time.Second)
+	waitFor(t, "the panic to be logged", func() bool {
+		return logger.contains("handler bug")
+	})
+
+	sendOnce(t, c.heartbeater("b"), time.Second)
+	c.clock.Advance(2 * time.Second)
+	waitFor(t, "b to be reported stale", func() bool {
+		staleNodes := handler.staleNodes()
+		return len(staleNodes) > 0 && staleNodes[len(staleNodes)-1] == "b"
+	})
+
+}
+
+// A panic while sending is reported on Errors, and the sender carries on
+func TestSenderSurvivesPanic(t *testing.T) {
+
+	c := newCluster(t)
+	clock := newTimerClock(c.clock)
+	h := c.heartbeater("a", cbheartbeat.WithClock(clock))
+	panicked := false
+	c.store.SetFailure(func(op, docId string) error {
+		if !panicked {
+			panicked = true
+			panic("store bug")
+		}
+		return nil
+	})
+	if err := h.StartSendingHeartbeatsContext(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-h.Errors():
+		var heartbeatErr *cbheartbeat.HeartbeatError
+		if !errors.As(err, &heartbeatErr) || heartbeatErr.Op != cbheartbeat.OpSend || !strings.Contains(err.Error(), "store bug") {
+			t.Fatalf("got error %v, want the panic", err)
+		}
+	default:
+		t.Fatal("panic wasn't reported")
+	}
+
+	nextTimer(t, clock)
+	c.clock.Advance(time.Second)
+	nextTimer(t, clock)
+	if _, ok := c.store.TTL(timeoutDocId("a")); !ok {
+		t.Fatal("no heartbeat written after the panic")
+	}
+
+}
+
+type recordingLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+// Whether any line logged so far contains s
+func (l *recordingLogger) contains(s string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes whose docs would collide without escaping see each other
+func TestNodeUuidsWithSeparators(t *testing.T) {
+	c := newCluster(t)
+	nodeUuids := []string{"10.0.0.1:8091", "10.0.0.1%3A8091", "node a", "node%20a"}
+	for _, nodeUuid := range nodeUuids {
+		sendOnce(t, c.heartbeater(nodeUuid), time.Minute)
+	}
+	liveNodes, err := c.heartbeater("checker").LiveNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(liveNodes)
+	sort.Strings(nodeUuids)
+	if !reflect.DeepEqual(liveNodes, nodeUuids) {
+		t.Fatalf("LiveNodes = %q, want %q", liveNodes, nodeUuids)
+	}
+}
+
+func TestRestart(t *testing.T) {
+
+	c := newCluster(t)
+	clock := newTimerClock(c.clock)
+	h := c.heartbeater("a", cbheartbeat.WithClock(clock))
+	for i := 0; i < 2; i++ {
+		if err := h.Start(time.Second, time.Hour, nil); err != nil {
+			t.Fatalf("start %v: %v", i+1, err)
+		}
+		nextTimer(t, clock)
+		upserts := c.store.Ops(cbheartbeattest.OpUpsert)
+		c.clock.Advance(time.Second)
+		nextTimer(t, clock)
+		if got := c.store.Ops(cbheartbeattest.OpUpsert); got != upserts+2 {
+			t.Fatalf("%v upserts a second after start %v, want %v", got, i+1, upserts+2)
+		}
+		if _, err := h.RunCheck(); err != nil {
+			t.Fatalf("check after start %v: %v", i+1, err)
+		}
+		h.Stop()
+		h.Wait()
+	}
+
+}
+
+// With WithMinimalWrites, heartbeats only touch the docs, unless the timeout
+// doc has expired in the meantime
+func TestMinimalWrites(t *testing.T) {
+
+	c := newCluster(t)
+	h := c.heartbeater("a", cbheartbeat.WithMinimalWrites(true))
+	sendOnce(t, h, time.Second)
+	upserts := c.store.Ops(cbheartbeattest.OpUpsert)
+
+	c.clock.Advance(time.Second)
+	sendOnce(t, h, time.Second)
+	if got := c.store.Ops(cbheartbeattest.OpUpsert); got != upserts {
+		t.Fatalf("%v upserts, want %v", got, upserts)
+	}
+	if touches := c.store.Ops(cbheartbeattest.OpTouch); touches != 2 {
+		t.Fatalf("%v touches, want 2", touches)
+	}
+	if ttl, _ := c.store.TTL(timeoutDocId("a")); ttl != 2*time.Second {
+		t.Fatalf("timeout doc ttl %v after touching it, want 2s", ttl)
+	}
+
+	c.clock.Advance(2 * time.Second)
+	sendOnce(t, h, time.Second)
+	if got := c.store.Ops(cbheartbeattest.OpUpsert); got != upserts+2 {
+		t.Fatalf("%v upserts after the timeout doc expired, want %v", got, upserts+2)
+	}
+	if ttl, ok := c.store.TTL(timeoutDocId("a")); !ok || ttl != 2*time.Second {
+		t.Fatalf("timeout doc ttl %v (exists %v) after rewriting it, want 2s", ttl, ok)
+	}
+
+}
+
+// This node's own record is alive as long as it is sending
+func TestAllHeartbeatRecords(t *testing.T) {
+
+	c := newCluster(t)
+	a := c.heartbeater("a")
+	if err := a.StartSendingHeartbeatsContext(context.Background(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	sendOnce(t, c.heartbeater("b"), time.Second)
+	c.clock.Advance(2 * time.Second)
+
+	records, err := a.AllHeartbeatRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, record := range records {
+		got = append(got, fmt.Sprintf("%v alive=%v self=%v", record.NodeUUID, record.Alive, record.Self))
+	}
+	want := []string{"a alive=true self=true", "b alive=false self=false"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("AllHeartbeatRecords gave %q, want %q", got, want)
+	}
+
+}
+
+func TestInvalidErrorsBufferSize(t *testing.T) {
+	_, err := cbheartbeat.NewHeartbeaterWithStore(newCluster(t).store,
+		cbheartbeat.WithNodeUUID("a"), cbheartbeat.WithErrorsBufferSize(-1))
+	if err == nil || !strings.Contains(err.Error(), "Invalid errors buffer size") {
+		t.Fatalf("got error %v, want an invalid errors buffer size", err)
+	}
+}
+
+// Observers don't need a nodeUuid, but the rest of the options are still
+// checked
+func TestObserverOptionsValidated(t *testing.T) {
+	store := newCluster(t).store
+	if _, err := cbheartbeat.NewHeartbeaterWithStore(store, cbheartbeat.WithObserver(true)); err != nil {
+		t.Fatalf("observer without a nodeUuid: %v", err)
+	}
+	_, err := cbheartbeat.NewHeartbeaterWithStore(store, cbheartbeat.WithObserver(true), cbheartbeat.WithKeyPrefix("app\n"))
+	if err == nil || !strings.Contains(err.Error(), "Invalid keyPrefix") {
+		t.Fatalf("got error %v, want an invalid keyPrefix", err)
+	}
+}
+
+// The view and N1QL settings only apply to the default go-couchbase store
+func TestConfigWithStore(t *testing.T) {
+	h := newCluster(t).heartbeater("a", cbheartbeat.WithDesignDoc("app"), cbheartbeat.WithN1QL("http://localhost:8093"))
+	config := h.Config()
+	if config.NodeUUID != "a" {
+		t.Errorf("NodeUUID %q, want a", config.NodeUUID)
+	}
+	if config.DesignDocName != "" || config.ViewName != "" || config.UseN1QL {
+		t.Errorf("got go-couchbase settings %+v for a MemoryStore", config)
+	}
+}
+
+// Once its context is cancelled, NodeInfosContext returns straight away, and
+// the abandoned query doesn't go on to look up any timeout docs
+func TestNodeInfosContextCancelled(t *testing.T) {
+
+	c := newCluster(t)
+	sendOnce(t, c.heartbeater("b"), time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	gets := make(chan string, 1)
+	c.store.SetFailure(func(op, docId string) error {
+		switch op {
+		case cbheartbeattest.OpQuery:
+			cancel()
+			<-release
+		case cbheartbeattest.OpGet:
+			gets <- docId
+		}
+		return nil
+	})
+
+	if _, err := c.heartbeater("a").NodeInfosContext(ctx); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	select {
+	case docId := <-gets:
+		t.Fatalf("looked up %v after the context was cancelled", docId)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+}
+
+// The phi accrual detector reports a node whose heartbeats stop well before
+// its timeout doc expires
+func TestPhiAccrual(t *testing.T) {
+
+	c := newCluster(t)
+	handler := &recordingHandler{}
+	checker := c.heartbeater("checker", cbheartbeat.WithPhiAccrual(8))
+	startChecker(t, checker, handler)
+	a := c.heartbeater("a", cbheartbeat.WithTimeoutMultiplier(10))
+	for i := 0; i < 5; i++ {
+		sendOnce(t, a, time.Second)
+		runCheck(t, checker)
+		c.clock.Advance(time.Second)
+	}
+	if len(handler.stale) != 0 || checker.Phi("a") > 1 {
+		t.Fatalf("stale = %v, phi %v while a was sending", handler.stale, checker.Phi("a"))
+	}
+
+	c.clock.Advance(time.Second)
+	runCheck(t, checker)
+	if !reflect.DeepEqual(handler.stale, []string{"a"}) {
+		t.Fatalf("stale = %v a second after a's heartbeats stopped, want [a]", handler.stale)
+	}
+
+}
+
+// Also records the nodes passed to it over the stale handler limit
+type coalescingHandler struct {
+	recordingHandler
+	coalesced [][]string
+}
+
+func (r *coalescingHandler) StaleHeartBeatsCoalesced(events []cbheartbeat.StaleEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	nodeUuids := []string{}
+	for _, event := range events {
+		nodeUuids = append(nodeUuids, event.NodeUUID)
+	}
+	r.coalesced = append(r.coalesced, nodeUuids)
+}
+
+// Handlers hear about at most the limit of stale nodes per check.  The rest
+// are passed in one go to a CoalescedStaleHandler, and queued for the other
+// handlers unless they rejoin in the meantime.
+func TestStaleHandlerLimit(t *testing.T) {
+
+	c := newCluster(t)
+	handler := &recordingHandler{}
+	coalescing := &coalescingHandler{}
+	checker := c.heartbeater("checker", cbheartbeat.WithStaleHandlerLimit(2), cbheartbeat.WithLogger(discardLogger{}))
+	checker.AddStaleHandler(coalescing)
+	startChecker(t, checker, handler)
+	nodeUuids := []string{"a", "b", "c", "d", "e"}
+	for _, nodeUuid := range nodeUuids {
+		sendOnce(t, c.heartbeater(nodeUuid), time.Second)
+	}
+	c.clock.Advance(2 * time.Second)
+
+	runCheck(t, checker)
+	if !reflect.DeepEqual(handler.stale, []string{"a", "b"}) {
+		t.Fatalf("stale = %v after the first check, want [a b]", handler.stale)
+	}
+	if !reflect.DeepEqual(coalescing.stale, []string{"a", "b"}) || !reflect.DeepEqual(coalescing.coalesced, [][]string{{"c", "d", "e"}}) {
+		t.Fatalf("coalescing handler got stale %v and coalesced %v, want [a b] and [[c d e]]", coalescing.stale, coalescing.coalesced)
+	}
+	if staleNodes := drain(checker.StaleEvents()); !reflect.DeepEqual(staleNodes, nodeUuids) {
+		t.Fatalf("StaleEvents gave %v, want every node straight away", staleNodes)
+	}
+
+	sendOnce(t, c.heartbeater("c"), time.Minute)
+	runCheck(t, checker)
+	if !reflect.DeepEqual(handler.stale, []string{"a", "b", "d", "e"}) {
+		t.Fatalf("stale = %v after c rejoined, want [a b d e]", handler.stale)
+	}
+	if len(coalescing.stale) != 2 {
+		t.Fatalf("coalescing handler was also notified about the queued nodes: %v", coalescing.stale)
+	}
+
+}
+
+// A checker which restarts doesn't report a node again while the marker
+// left by the first report is there, but does once it has expired
+func TestStaleMarkerTTL(t *testing.T) {
+
+	c := newCluster(t)
+	opts := []cbheartbeat.Option{cbheartbeat.WithKeepStaleDocs(true), cbheartbeat.WithStaleMarkerTTL(time.Minute)}
+	sendOnce(t, c.heartbeater("a"), time.Second)
+	c.clock.Advance(2 * time.Second)
+	firstReport := c.clock.Now()
+
+	for _, test := range []struct {
+		advance time.Duration
+		want    []string
+	}{
+		{0, []string{"a"}},
+		{30 * time.Second, []string{}},
+		{30 * time.Second, []string{"a"}},
+	} {
+		c.clock.Advance(test.advance)
+		handler := &recordingHandler{stale: []string{}}
+		checker := c.heartbeater("checker", opts...)
+		startChecker(t, checker, handler)
+		runCheck(t, checker)
+		if err := checker.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(handler.stale, test.want) {
+			t.Fatalf("restarted checker reported %v %v after the first report, want %v", handler.stale, c.clock.Now().Sub(firstReport), test.want)
+		}
+	}
+
+}
@@ -0,0 +1,261 @@
+// Package cbgocb provides a cbheartbeat.Store built on the gocb v2 SDK, for
+// users who don't want to depend on the legacy go-couchbase library.  It
+// uses the same doc layout as the default store, so both kinds of node can
+// run in one cluster while migrating, as long as they share a collection.
+package cbgocb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/tleyden/cb-heartbeat"
+)
+
+// Create a new Heartbeater which keeps its heartbeat docs in the given
+// collection, and finds them with N1QL.  Takes the same Options as
+// cbheartbeat.NewCouchbaseHeartbeaterWithOptions, minus the ones that only
+// apply to go-couchbase.  The collection must be in a bucket with the query
+// service available, and may be any collection, unlike with go-couchbase,
+// whose map-reduce views only index the default one.
+func NewGocbHeartbeater(collection *gocb.Collection, opts ...cbheartbeat.Option) (cbheartbeat.Heartbeater, error) {
+	return cbheartbeat.NewHeartbeaterWithStore(NewStore(collection), opts...)
+}
+
+// A cbheartbeat.Store backed by a gocb collection
+type Store struct {
+	collection *gocb.Collection
+}
+
+var _ cbheartbeat.Store = &Store{}
+var _ cbheartbeat.TouchStore = &Store{}
+var _ cbheartbeat.BulkWriteStore = &Store{}
+var _ cbheartbeat.CasStore = &Store{}
+
+// Create a Store which keeps heartbeat docs in the given collection
+func NewStore(collection *gocb.Collection) *Store {
+	return &Store{
+		collection: collection,
+	}
+}
+
+func (s *Store) Upsert(docId string, doc interface{}, ttl time.Duration) error {
+	_, err := s.collection.Upsert(docId, doc, &gocb.UpsertOptions{
+		Expiry: roundUpToSeconds(ttl),
+	})
+	return err
+}
+
+func (s *Store) Insert(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+	_, err := s.collection.Insert(docId, doc, &gocb.InsertOptions{
+		Expiry: roundUpToSeconds(ttl),
+	})
+	if errors.Is(err, gocb.ErrDocumentExists) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Uses the SDK's bulk operations, which pipeline the writes on one connection
+func (s *Store) UpsertBulk(writes []cbheartbeat.BulkWrite) []error {
+
+	ops := make([]gocb.BulkOp, len(writes))
+	upsertOps := make([]*gocb.UpsertOp, len(writes))
+	for i, write := range writes {
+		upsertOps[i] = &gocb.UpsertOp{
+			ID:     write.DocId,
+			Value:  write.Doc,
+			Expiry: roundUpToSeconds(write.TTL),
+		}
+		ops[i] = upsertOps[i]
+	}
+
+	errs := make([]error, len(writes))
+	if err := s.collection.Do(ops, nil); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	for i, op := range upsertOps {
+		errs[i] = op.Err
+	}
+	return errs
+
+}
+
+// Reads the doc with its CAS, and only replaces it if the CAS hasn't changed
+func (s *Store) Renew(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+	result, err := s.collection.Get(docId, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return false, cbheartbeat.ErrDocNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	var current json.RawMessage
+	if err := result.Content(&current); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(current, value) {
+		return false, nil
+	}
+
+	_, err = s.collection.Replace(docId, doc, &gocb.ReplaceOptions{
+		Cas:    result.Cas(),
+		Expiry: roundUpToSeconds(ttl),
+	})
+	if errors.Is(err, gocb.ErrCasMismatch) {
+		return false, nil
+	}
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return false, cbheartbeat.ErrDocNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+
+}
+
+func (s *Store) Touch(docId string, ttl time.Duration) error {
+	_, err := s.collection.Touch(docId, roundUpToSeconds(ttl), nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return cbheartbeat.ErrDocNotFound
+	}
+	return err
+}
+
+func (s *Store) Get(docId string, doc interface{}) error {
+	result, err := s.collection.Get(docId, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return cbheartbeat.ErrDocNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return result.Content(doc)
+}
+
+func (s *Store) Delete(docId string) error {
+	_, err := s.collection.Remove(docId, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return cbheartbeat.ErrDocNotFound
+	}
+	return err
+}
+
+// Create the N1QL index used by QueryHeartbeatDocs, if it doesn't already exist
+func (s *Store) PrepareHeartbeatQuery(heartbeatDocType string) error {
+
+	// eg "heartbeats" for the default doc type
+	statement := fmt.Sprintf(
+		"CREATE INDEX `%vs` ON `%v`(type) WHERE type = %v",
+		heartbeatDocType,
+		s.collection.Name(),
+		n1qlString(heartbeatDocType),
+	)
+
+	result, err := s.scope().Query(statement, nil)
+	if err != nil {
+		if errors.Is(err, gocb.ErrIndexExists) || strings.Contains(err.Error(), "already exists") {
+			return nil
+		}
+		return err
+	}
+	return result.Close()
+
+}
+
+func (s *Store) QueryHeartbeatDocs(heartbeatDocType, docIdPrefix string) ([]json.RawMessage, error) {
+
+	// U+10FFFF is the highest code point, so it sorts after any character
+	// in a doc id, apart from itself, which the doc ids escape
+	statement := fmt.Sprintf(
+		"SELECT c.* FROM `%v` AS c WHERE c.type = %v AND META(c).id >= %v AND META(c).id < %v",
+		s.collection.Name(),
+		n1qlString(heartbeatDocType),
+		n1qlString(docIdPrefix),
+		n1qlString(docIdPrefix+"\U0010ffff"),
+	)
+
+	result, err := s.scope().Query(statement, &gocb.QueryOptions{
+		ScanConsistency: gocb.QueryScanConsistencyRequestPlus,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	heartbeats := []json.RawMessage{}
+	for result.Next() {
+		heartbeat := json.RawMessage{}
+		if err := result.Row(&heartbeat); err != nil {
+			return nil, err
+		}
+		heartbeats = append(heartbeats, heartbeat)
+	}
+	return heartbeats, result.Err()
+
+}
+
+// The cluster connection belongs to the caller, so there is nothing to close
+func (s *Store) Close() error {
+	return nil
+}
+
+func (s *Store) scope() *gocb.Scope {
+	return s.collection.Bucket().Scope(s.collection.ScopeName())
+}
+
+// Couchbase expiries have a resolution of one second, so round up rather
+// than risk a sub-second ttl being truncated to zero, meaning never expire
+func roundUpToSeconds(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return 0
+	}
+	return (ttl + time.Second - 1) / time.Second * time.Second
+}
+
+var _ cbheartbeat.DurableStore = &Store{}
+
+func (s *Store) UpsertDurable(docId string, doc interface{}, ttl time.Duration, durability cbheartbeat.Durability) error {
+
+	level := gocb.DurabilityLevelNone
+	switch durability {
+	case cbheartbeat.DurabilityNone:
+	case cbheartbeat.DurabilityMajority:
+		level = gocb.DurabilityLevelMajority
+	case cbheartbeat.DurabilityMajorityAndPersistActive:
+		level = gocb.DurabilityLevelMajorityAndPersistOnMaster
+	case cbheartbeat.DurabilityPersistToMajority:
+		level = gocb.DurabilityLevelPersistToMajority
+	default:
+		return fmt.Errorf("Durability %v is not supported by gocb", durability)
+	}
+
+	_, err := s.collection.Upsert(docId, doc, &gocb.UpsertOptions{
+		Expiry:          roundUpToSeconds(ttl),
+		DurabilityLevel: level,
+	})
+	return err
+
+}
+
+// Quote a string for use as a N1QL string literal
+func n1qlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
@@ -0,0 +1,153 @@
+package cbheartbeattest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+)
+
+// A cbheartbeat.Clock that only moves when Advance is called, for passing
+// to cbheartbeat.WithClock.  Tickers and timers fire from Advance, and like
+// real ones they drop ticks rather than block if nobody is receiving.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+var _ cbheartbeat.Clock = &FakeClock{}
+
+// A fake ticker or timer
+type fakeWaiter struct {
+	clock  *FakeClock
+	c      chan time.Time
+	fireAt time.Time
+	period time.Duration // zero for a timer
+	active bool          // in the clock's waiters, ie not stopped or fired
+}
+
+// Create a fake clock set to the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Move the clock forward, firing any tickers and timers that are due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !w.fireAt.After(c.now) {
+			select {
+			case w.c <- c.now:
+			default:
+			}
+			if w.period == 0 {
+				// fired, so forgotten until it is reset
+				w.active = false
+				continue
+			}
+			for !w.fireAt.After(c.now) {
+				w.fireAt = w.fireAt.Add(w.period)
+			}
+		}
+		waiters = append(waiters, w)
+	}
+	for i := len(waiters); i < len(c.waiters); i++ {
+		c.waiters[i] = nil
+	}
+	c.waiters = waiters
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) cbheartbeat.Ticker {
+	return fakeTicker{c.newWaiter(d, d)}
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) cbheartbeat.Timer {
+	return fakeTimer{c.newWaiter(d, 0)}
+}
+
+func (c *FakeClock) newWaiter(d, period time.Duration) *fakeWaiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &fakeWaiter{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		fireAt: c.now.Add(d),
+		period: period,
+		active: true,
+	}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeWaiter) stop() bool {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	wasActive := w.active
+	w.clock.remove(w)
+	return wasActive
+}
+
+func (w *fakeWaiter) reset(d time.Duration) bool {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	wasActive := w.active
+	if !w.active {
+		w.active = true
+		w.clock.waiters = append(w.clock.waiters, w)
+	}
+	w.fireAt = w.clock.now.Add(d)
+	return wasActive
+}
+
+// Forget a stopped ticker or timer, so that a long-running test which keeps
+// creating them doesn't keep checking them all.  Must be called with the
+// mutex held.
+func (c *FakeClock) remove(w *fakeWaiter) {
+	if !w.active {
+		return
+	}
+	w.active = false
+	for i, waiter := range c.waiters {
+		if waiter == w {
+			last := len(c.waiters) - 1
+			copy(c.waiters[i:], c.waiters[i+1:])
+			c.waiters[last] = nil
+			c.waiters = c.waiters[:last]
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.stop()
+}
+
+type fakeTimer struct {
+	*fakeWaiter
+}
+
+func (t fakeTimer) Stop() bool {
+	return t.stop()
+}
+
+func (t fakeTimer) Reset(d time.Duration) bool {
+	return t.reset(d)
+}
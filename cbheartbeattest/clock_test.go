@@ -0,0 +1,39 @@
+package cbheartbeattest
+
+import (
+	"testing"
+	"time"
+)
+
+// Stopped and fired timers are forgotten, and come back when reset
+func TestFakeClockForgetsWaiters(t *testing.T) {
+
+	clock := NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	ticker := clock.NewTicker(time.Second)
+	stopped := clock.NewTimer(time.Second)
+	fired := clock.NewTimer(time.Second)
+	if len(clock.waiters) != 3 {
+		t.Fatalf("%v waiters, want 3", len(clock.waiters))
+	}
+
+	if !stopped.Stop() {
+		t.Fatal("Stop returned false for an active timer")
+	}
+	clock.Advance(time.Second)
+	<-fired.C()
+	<-ticker.C()
+	if len(clock.waiters) != 1 {
+		t.Fatalf("%v waiters after a timer was stopped and another fired, want just the ticker", len(clock.waiters))
+	}
+
+	if stopped.Reset(time.Second) {
+		t.Fatal("Reset returned true for a stopped timer")
+	}
+	clock.Advance(time.Second)
+	<-stopped.C()
+	ticker.Stop()
+	if len(clock.waiters) != 0 {
+		t.Fatalf("%v waiters, want none", len(clock.waiters))
+	}
+
+}
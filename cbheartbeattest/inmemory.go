@@ -0,0 +1,422 @@
+// Package cbheartbeattest provides an in-memory cbheartbeat.Heartbeater, so
+// that code which depends on a Heartbeater can be tested without Couchbase,
+// and helpers such as WaitForStale for tests which do use Couchbase.
+package cbheartbeattest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+)
+
+// An in-memory Heartbeater driven by a fake clock.  Other nodes are added
+// with AddNode and kept alive with Beat, and time only moves when Advance
+// is called, which also runs the stale heartbeat check synchronously.  So
+// the handler is called back on the test's own goroutine, deterministically.
+//
+// The checking is done by a real heartbeater, and each other node's docs are
+// written by a real heartbeater of its own, all sharing a MemoryStore, so
+// stale and rejoined nodes are reported exactly as they would be against
+// Couchbase.  This node's own sending is only simulated.
+type InMemoryHeartbeater struct {
+	mutex          sync.Mutex
+	nodeUuid       string
+	clock          *FakeClock
+	store          *MemoryStore
+	checker        cbheartbeat.Heartbeater
+	nodes          map[string]*node
+	metadata       map[string]string
+	sendCtx        context.Context
+	sendInterval   time.Duration
+	sendPaused     bool
+	lastSent       time.Time
+	lastSendTick   time.Time // the last Advance while sending, even if paused
+	checkCtx       context.Context
+	staleThreshold time.Duration
+}
+
+// Another node, which writes its heartbeat docs with its own heartbeater
+type node struct {
+	sender cbheartbeat.Heartbeater
+	ttl    time.Duration
+	beats  uint64
+}
+
+var _ cbheartbeat.Heartbeater = &InMemoryHeartbeater{}
+
+// Create an in-memory Heartbeater for the given (local) node.  The fake
+// clock starts at an arbitrary fixed time.
+func NewInMemoryHeartbeater(nodeUuid string) *InMemoryHeartbeater {
+	clock := NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := &InMemoryHeartbeater{
+		nodeUuid: nodeUuid,
+		clock:    clock,
+		store:    NewMemoryStore(clock),
+		nodes:    map[string]*node{},
+	}
+	h.checker = h.mustNewHeartbeater(nodeUuid)
+	return h
+}
+
+// A real heartbeater for the given node, on the shared store.  Panics if the
+// options are invalid, eg an empty nodeUuid, since that's a bug in the test.
+func (h *InMemoryHeartbeater) mustNewHeartbeater(nodeUuid string, opts ...cbheartbeat.Option) cbheartbeat.Heartbeater {
+	opts = append([]cbheartbeat.Option{
+		cbheartbeat.WithNodeUUID(nodeUuid),
+		cbheartbeat.WithClock(manualClock{h.clock}),
+		cbheartbeat.WithLogger(discardLogger{}),
+	}, opts...)
+	heartbeater, err := cbheartbeat.NewHeartbeaterWithStore(h.store, opts...)
+	if err != nil {
+		panic(fmt.Sprintf("cbheartbeattest: %v", err))
+	}
+	return heartbeater
+}
+
+// Add another node which has just sent a heartbeat, and will be considered
+// stale once ttl passes without another call to Beat.  Panics if ttl isn't
+// positive.
+func (h *InMemoryHeartbeater) AddNode(nodeUuid string, ttl time.Duration, metadata map[string]string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if ttl <= 0 {
+		panic(fmt.Sprintf("cbheartbeattest: invalid ttl %v for node %v: must be positive", ttl, nodeUuid))
+	}
+	n := &node{
+		// with a multiplier of 1, the timeout doc lives for exactly ttl
+		sender: h.mustNewHeartbeater(nodeUuid, cbheartbeat.WithTimeoutMultiplier(1), cbheartbeat.WithMetadata(metadata)),
+		ttl:    ttl,
+	}
+	h.nodes[nodeUuid] = n
+	n.beat()
+}
+
+// Record a heartbeat from another node at the current fake time.  If the
+// node was reported stale, it will be reported as rejoined by the next check.
+func (h *InMemoryHeartbeater) Beat(nodeUuid string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if n, ok := h.nodes[nodeUuid]; ok {
+		n.beat()
+	}
+}
+
+// Write one heartbeat, by starting the node's sender, which writes the first
+// heartbeat straight away, and stopping it again before its timer can fire
+func (n *node) beat() {
+	if err := n.sender.StartSendingHeartbeatsContext(context.Background(), n.ttl); err != nil {
+		return
+	}
+	n.sender.StopSendingHeartbeats()
+	n.beats++
+}
+
+// The current fake time
+func (h *InMemoryHeartbeater) Now() time.Time {
+	return h.clock.Now()
+}
+
+// The store holding the other nodes' heartbeat docs, eg to inject failures
+// with SetFailure
+func (h *InMemoryHeartbeater) Store() *MemoryStore {
+	return h.store
+}
+
+// Move the fake clock forward, and then if the checker has been started,
+// check for stale nodes.  Handlers are called back before this returns.
+func (h *InMemoryHeartbeater) Advance(d time.Duration) {
+
+	h.clock.Advance(d)
+	h.mutex.Lock()
+	now := h.clock.Now()
+	if h.sendCtx != nil && h.sendCtx.Err() == nil && h.sendInterval > 0 {
+		h.lastSendTick = now
+		if !h.sendPaused {
+			h.lastSent = now
+		}
+	}
+	checking := h.checkCtx != nil && h.checkCtx.Err() == nil
+	h.mutex.Unlock()
+
+	// check outside the lock, so handlers can call back into us
+	if checking {
+		h.checker.RunCheck()
+	}
+
+}
+
+func (h *InMemoryHeartbeater) StartCheckingHeartbeats(staleThresholdMs int, handler cbheartbeat.HeartbeatsStoppedHandler) error {
+	return h.StartCheckingHeartbeatsContext(context.Background(), time.Duration(staleThresholdMs)*time.Millisecond, handler)
+}
+
+// Starts the real checker, whose ticker never fires since it runs on the
+// fake clock, so that checks only happen in Advance, RunCheck and CheckNow
+func (h *InMemoryHeartbeater) StartCheckingHeartbeatsContext(ctx context.Context, staleThreshold time.Duration, handler cbheartbeat.HeartbeatsStoppedHandler) error {
+	if err := h.checker.StartCheckingHeartbeatsContext(ctx, staleThreshold, handler); err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checkCtx = ctx
+	h.staleThreshold = staleThreshold
+	return nil
+}
+
+// Check for stale nodes without moving the fake clock
+func (h *InMemoryHeartbeater) CheckNow() error {
+	return h.checker.CheckNow()
+}
+
+// Check for stale nodes without moving the fake clock.  The duration is
+// always zero, since the fake clock doesn't move.
+func (h *InMemoryHeartbeater) RunCheck() (cbheartbeat.CheckResult, error) {
+	return h.checker.RunCheck()
+}
+
+func (h *InMemoryHeartbeater) StopCheckingHeartbeats() {
+	h.checker.StopCheckingHeartbeats()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checkCtx = nil
+}
+
+func (h *InMemoryHeartbeater) SetStaleHandler(handler cbheartbeat.HeartbeatsStoppedHandler) {
+	h.checker.SetStaleHandler(handler)
+}
+
+func (h *InMemoryHeartbeater) AddStaleHandler(handler cbheartbeat.HeartbeatsStoppedHandler) {
+	h.checker.AddStaleHandler(handler)
+}
+
+func (h *InMemoryHeartbeater) RemoveStaleHandler(handler cbheartbeat.HeartbeatsStoppedHandler) {
+	h.checker.RemoveStaleHandler(handler)
+}
+
+func (h *InMemoryHeartbeater) LiveNodes() ([]string, error) {
+	return h.checker.LiveNodes()
+}
+
+func (h *InMemoryHeartbeater) LiveNodesContext(ctx context.Context) ([]string, error) {
+	return h.checker.LiveNodesContext(ctx)
+}
+
+func (h *InMemoryHeartbeater) IsNodeAlive(nodeUuid string) (bool, error) {
+	return h.checker.IsNodeAlive(nodeUuid)
+}
+
+func (h *InMemoryHeartbeater) IsNodeAliveContext(ctx context.Context, nodeUuid string) (bool, error) {
+	return h.checker.IsNodeAliveContext(ctx, nodeUuid)
+}
+
+func (h *InMemoryHeartbeater) NodeInfos() ([]cbheartbeat.NodeInfo, error) {
+	return h.checker.NodeInfos()
+}
+
+func (h *InMemoryHeartbeater) NodeInfosContext(ctx context.Context) ([]cbheartbeat.NodeInfo, error) {
+	return h.checker.NodeInfosContext(ctx)
+}
+
+// Every node which hasn't been reported stale, since reporting a node stale
+// deletes its heartbeat doc
+func (h *InMemoryHeartbeater) AllHeartbeatRecords() ([]cbheartbeat.HeartbeatRecord, error) {
+	return h.checker.AllHeartbeatRecords()
+}
+
+func (h *InMemoryHeartbeater) SetExcludedNodes(nodeUuids []string) {
+	h.checker.SetExcludedNodes(nodeUuids)
+}
+
+func (h *InMemoryHeartbeater) StaleNodes() []string {
+	return h.checker.StaleNodes()
+}
+
+func (h *InMemoryHeartbeater) StaleEvents() <-chan string {
+	return h.checker.StaleEvents()
+}
+
+// Always zero, since the in-memory heartbeater has no phi accrual detector
+func (h *InMemoryHeartbeater) Phi(nodeUuid string) float64 {
+	return 0
+}
+
+// The number of heartbeats the node has sent, counting AddNode as the first
+func (h *InMemoryHeartbeater) LastSequence(nodeUuid string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if n, ok := h.nodes[nodeUuid]; ok {
+		return n.beats
+	}
+	return 0
+}
+
+// Always zero, since every node shares the fake clock
+func (h *InMemoryHeartbeater) ClockSkew(nodeUuid string) time.Duration {
+	return 0
+}
+
+// Receives the checker's errors, eg those injected with Store().SetFailure
+func (h *InMemoryHeartbeater) Errors() <-chan error {
+	return h.checker.Errors()
+}
+
+// Delete the heartbeat docs of nodes which aren't alive.  They come back if
+// Beat is called for them again.
+func (h *InMemoryHeartbeater) ReapStaleDocs() (int, error) {
+	return h.checker.ReapStaleDocs()
+}
+
+func (h *InMemoryHeartbeater) StartSendingHeartbeats(intervalMs int) error {
+	return h.StartSendingHeartbeatsContext(context.Background(), time.Duration(intervalMs)*time.Millisecond)
+}
+
+func (h *InMemoryHeartbeater) StartSendingHeartbeatsContext(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid send interval %v: must be positive", interval)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.sendCtx != nil && h.sendCtx.Err() == nil {
+		return cbheartbeat.ErrAlreadyRunning
+	}
+	h.sendCtx = ctx
+	h.sendInterval = interval
+	return nil
+}
+
+func (h *InMemoryHeartbeater) SetSendInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid send interval %v: must be positive", interval)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sendInterval = interval
+	return nil
+}
+
+func (h *InMemoryHeartbeater) StopSendingHeartbeats() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sendCtx = nil
+}
+
+func (h *InMemoryHeartbeater) PauseSending() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sendPaused = true
+}
+
+func (h *InMemoryHeartbeater) ResumeSending() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sendPaused = false
+}
+
+func (h *InMemoryHeartbeater) Start(sendInterval, staleThreshold time.Duration, handler cbheartbeat.HeartbeatsStoppedHandler) error {
+	if err := h.StartSendingHeartbeatsContext(context.Background(), sendInterval); err != nil {
+		return err
+	}
+	if err := h.StartCheckingHeartbeatsContext(context.Background(), staleThreshold, handler); err != nil {
+		h.StopSendingHeartbeats()
+		return err
+	}
+	return nil
+}
+
+func (h *InMemoryHeartbeater) Stop() {
+	h.StopSendingHeartbeats()
+	h.StopCheckingHeartbeats()
+}
+
+// Always returns ErrNoView, since there is no view
+func (h *InMemoryHeartbeater) QueryHeartbeatView() ([]cbheartbeat.HeartbeatViewRow, error) {
+	return nil, cbheartbeat.ErrNoView
+}
+
+// Waits for the checker's goroutine to exit after Stop
+func (h *InMemoryHeartbeater) Wait() {
+	h.checker.Wait()
+}
+
+// Always elects this node, since the other nodes are only simulated
+func (h *InMemoryHeartbeater) StartLeaderElection() (<-chan bool, error) {
+	isLeader := make(chan bool, 1)
+	isLeader <- true
+	return isLeader, nil
+}
+
+// Stops the sender and checker
+func (h *InMemoryHeartbeater) Close() error {
+	h.Stop()
+	return h.checker.Close()
+}
+
+func (h *InMemoryHeartbeater) Deregister() error {
+	return nil
+}
+
+func (h *InMemoryHeartbeater) SenderHealth() (lastSuccess time.Time, lastErr error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.lastSent, nil
+}
+
+// Only the node uuid, send interval and stale threshold are filled in
+func (h *InMemoryHeartbeater) Config() cbheartbeat.HeartbeaterConfig {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return cbheartbeat.HeartbeaterConfig{
+		NodeUUID:       h.nodeUuid,
+		SendInterval:   h.sendInterval,
+		StaleThreshold: h.staleThreshold,
+		CheckInterval:  h.staleThreshold,
+	}
+}
+
+func (h *InMemoryHeartbeater) LastSendAttempt() time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.lastSendTick
+}
+
+func (h *InMemoryHeartbeater) LastCheckAttempt() time.Time {
+	return h.checker.LastCheckAttempt()
+}
+
+func (h *InMemoryHeartbeater) SetMetadata(metadata map[string]string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.metadata = metadata
+}
+
+// The clock the real heartbeaters run on: the fake time, but with tickers
+// and timers which never fire, since Advance runs each check itself, and
+// each heartbeat is sent by Beat
+type manualClock struct {
+	*FakeClock
+}
+
+func (c manualClock) NewTicker(d time.Duration) cbheartbeat.Ticker {
+	return idleTicker{}
+}
+
+func (c manualClock) NewTimer(d time.Duration) cbheartbeat.Timer {
+	return idleTimer{}
+}
+
+type idleTicker struct{}
+
+func (idleTicker) C() <-chan time.Time { return nil }
+func (idleTicker) Stop()               {}
+
+type idleTimer struct{}
+
+func (idleTimer) C() <-chan time.Time        { return nil }
+func (idleTimer) Stop() bool                 { return false }
+func (idleTimer) Reset(d time.Duration) bool { return false }
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, args ...interface{}) {}
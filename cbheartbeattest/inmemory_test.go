@@ -0,0 +1,154 @@
+package cbheartbeattest_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+	"github.com/tleyden/cb-heartbeat/cbheartbeattest"
+)
+
+// Records every callback, in order
+type recordingHandler struct {
+	mutex    sync.Mutex
+	stale    []string
+	rejoined []string
+}
+
+func (r *recordingHandler) StaleHeartBeatDetected(nodeUuid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stale = append(r.stale, nodeUuid)
+}
+
+func (r *recordingHandler) NodeRejoined(nodeUuid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rejoined = append(r.rejoined, nodeUuid)
+}
+
+func TestInMemoryRunCheckNotStarted(t *testing.T) {
+	h := cbheartbeattest.NewInMemoryHeartbeater("local")
+	if _, err := h.RunCheck(); err != cbheartbeat.ErrCheckerNotStarted {
+		t.Fatalf("RunCheck before starting the checker returned %v, want ErrCheckerNotStarted", err)
+	}
+	if err := h.CheckNow(); err != cbheartbeat.ErrCheckerNotStarted {
+		t.Fatalf("CheckNow before starting the checker returned %v, want ErrCheckerNotStarted", err)
+	}
+}
+
+func TestInMemoryStaleAndRejoined(t *testing.T) {
+
+	h := cbheartbeattest.NewInMemoryHeartbeater("local")
+	handler := &recordingHandler{}
+	if err := h.StartCheckingHeartbeatsContext(context.Background(), time.Second, handler); err != nil {
+		t.Fatal(err)
+	}
+	h.AddNode("a", 10*time.Second, nil)
+
+	h.Advance(9 * time.Second)
+	if len(handler.stale) != 0 {
+		t.Fatalf("node reported stale before its ttl passed: %v", handler.stale)
+	}
+	h.Advance(time.Second)
+	if !reflect.DeepEqual(handler.stale, []string{"a"}) {
+		t.Fatalf("stale = %v, want [a]", handler.stale)
+	}
+	h.Advance(time.Second)
+	if len(handler.stale) != 1 {
+		t.Fatalf("node reported stale more than once: %v", handler.stale)
+	}
+	if staleNodes := h.StaleNodes(); !reflect.DeepEqual(staleNodes, []string{"a"}) {
+		t.Fatalf("StaleNodes = %v, want [a]", staleNodes)
+	}
+
+	h.Beat("a")
+	h.Advance(time.Second)
+	if !reflect.DeepEqual(handler.rejoined, []string{"a"}) {
+		t.Fatalf("rejoined = %v, want [a]", handler.rejoined)
+	}
+	if staleNodes := h.StaleNodes(); len(staleNodes) != 0 {
+		t.Fatalf("StaleNodes = %v after rejoining, want none", staleNodes)
+	}
+
+}
+
+// One node rejoining while another goes stale in the same check must count
+// as one stale node, not zero
+func TestInMemoryRunCheckCountsStaleAndRejoinedTogether(t *testing.T) {
+
+	h := cbheartbeattest.NewInMemoryHeartbeater("local")
+	if err := h.StartCheckingHeartbeatsContext(context.Background(), time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	h.AddNode("a", 10*time.Second, nil)
+	h.Advance(10 * time.Second)
+	if staleNodes := h.StaleNodes(); !reflect.DeepEqual(staleNodes, []string{"a"}) {
+		t.Fatalf("StaleNodes = %v, want [a]", staleNodes)
+	}
+
+	h.AddNode("b", 5*time.Second, nil)
+	h.Beat("a")
+	h.StopCheckingHeartbeats()
+	h.Advance(5 * time.Second)
+
+	result, err := h.RunCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StaleNodes != 1 || result.LiveNodes != 1 {
+		t.Fatalf("RunCheck = %+v, want 1 stale and 1 live node", result)
+	}
+	if staleNodes := h.StaleNodes(); !reflect.DeepEqual(staleNodes, []string{"b"}) {
+		t.Fatalf("StaleNodes = %v, want [b]", staleNodes)
+	}
+
+}
+
+func TestInMemoryStaleEvent(t *testing.T) {
+
+	h := cbheartbeattest.NewInMemoryHeartbeater("local")
+	events := make(chan cbheartbeat.StaleEvent, 1)
+	handler := detailedHandler(func(event cbheartbeat.StaleEvent) { events <- event })
+	if err := h.StartCheckingHeartbeatsContext(context.Background(), time.Minute, handler); err != nil {
+		t.Fatal(err)
+	}
+	addedAt := h.Now()
+	h.AddNode("a", 10*time.Second, map[string]string{"host": "a.example.com"})
+	h.Advance(12 * time.Second)
+
+	select {
+	case event := <-events:
+		if event.NodeUUID != "a" || !event.LastSeen.Equal(addedAt) || event.Metadata["host"] != "a.example.com" {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+		// the node's own timeout, not the checker's threshold
+		if event.StaleThreshold != 10*time.Second || event.OverThreshold != 2*time.Second {
+			t.Fatalf("event threshold %v over by %v, want 10s over by 2s", event.StaleThreshold, event.OverThreshold)
+		}
+	default:
+		t.Fatal("no stale event")
+	}
+	select {
+	case nodeUuid := <-h.StaleEvents():
+		if nodeUuid != "a" {
+			t.Fatalf("StaleEvents got %v, want a", nodeUuid)
+		}
+	default:
+		t.Fatal("nothing on StaleEvents")
+	}
+
+}
+
+type detailedHandler func(event cbheartbeat.StaleEvent)
+
+func (f detailedHandler) StaleHeartBeatDetected(nodeUuid string) {
+	panic("StaleHeartBeatDetectedEvent should have been called instead")
+}
+
+func (f detailedHandler) StaleHeartBeatDetectedEvent(event cbheartbeat.StaleEvent) {
+	f(event)
+}
@@ -0,0 +1,268 @@
+package cbheartbeattest
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+)
+
+// An in-memory cbheartbeat.Store, for passing to
+// cbheartbeat.NewHeartbeaterWithStore in tests.  Docs expire by the given
+// clock, eg a FakeClock, so several heartbeaters sharing the store and the
+// clock make a deterministic cluster.  It also counts operations and can be
+// made to fail, see Ops and SetFailure.
+type MemoryStore struct {
+	mutex   sync.Mutex
+	clock   cbheartbeat.Clock
+	docs    map[string]memoryDoc
+	ops     map[string]int
+	failure func(op, docId string) error
+}
+
+var _ cbheartbeat.Store = &MemoryStore{}
+var _ cbheartbeat.TouchStore = &MemoryStore{}
+var _ cbheartbeat.CasStore = &MemoryStore{}
+
+// The operations counted by Ops and passed to the SetFailure function.  The
+// doc id passed with OpQuery is the doc id prefix.
+const (
+	OpUpsert = "Upsert"
+	OpInsert = "Insert"
+	OpGet    = "Get"
+	OpDelete = "Delete"
+	OpTouch  = "Touch"
+	OpRenew  = "Renew"
+	OpQuery  = "Query"
+)
+
+type memoryDoc struct {
+	value     json.RawMessage
+	expiresAt time.Time // zero if it never expires
+}
+
+// Create an empty store whose docs expire by the given clock
+func NewMemoryStore(clock cbheartbeat.Clock) *MemoryStore {
+	return &MemoryStore{
+		clock: clock,
+		docs:  map[string]memoryDoc{},
+		ops:   map[string]int{},
+	}
+}
+
+// Make every operation call failure first, and fail with the error it
+// returns unless that's nil, eg to simulate an outage or a conflict.  Pass
+// nil to stop failing.
+func (s *MemoryStore) SetFailure(failure func(op, docId string) error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failure = failure
+}
+
+// How many times the given operation has been called, including calls
+// which failed
+func (s *MemoryStore) Ops(op string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ops[op]
+}
+
+// How long until the doc expires, zero if it never does, and whether it
+// exists at all
+func (s *MemoryStore) TTL(docId string) (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	doc, ok := s.lookup(docId)
+	if !ok || doc.expiresAt.IsZero() {
+		return 0, ok
+	}
+	return doc.expiresAt.Sub(s.clock.Now()), true
+}
+
+// The ids of every doc which hasn't expired, sorted
+func (s *MemoryStore) DocIds() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	docIds := []string{}
+	for docId := range s.docs {
+		if _, ok := s.lookup(docId); ok {
+			docIds = append(docIds, docId)
+		}
+	}
+	sort.Strings(docIds)
+	return docIds
+}
+
+func (s *MemoryStore) Upsert(docId string, doc interface{}, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.begin(OpUpsert, docId); err != nil {
+		return err
+	}
+	return s.write(docId, doc, ttl)
+}
+
+func (s *MemoryStore) Insert(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.begin(OpInsert, docId); err != nil {
+		return false, err
+	}
+	if _, ok := s.lookup(docId); ok {
+		return false, nil
+	}
+	return true, s.write(docId, doc, ttl)
+}
+
+func (s *MemoryStore) Get(docId string, doc interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.begin(OpGet, docId); err != nil {
+		return err
+	}
+	stored, ok := s.lookup(docId)
+	if !ok {
+		return cbheartbeat.ErrDocNotFound
+	}
+	return json.Unmarshal(stored.value, doc)
+}
+
+func (s *MemoryStore) Delete(docId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.begin(OpDelete, docId); err != nil {
+		return err
+	}
+	if _, ok := s.lookup(docId); !ok {
+		return cbheartbeat.ErrDocNotFound
+	}
+	delete(s.docs, docId)
+	return nil
+}
+
+func (s *MemoryStore) Touch(docId string, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.begin(OpTouch, docId); err != nil {
+		return err
+	}
+	stored, ok := s.lookup(docId)
+	if !ok {
+		return cbheartbeat.ErrDocNotFound
+	}
+	stored.expiresAt = s.expiry(ttl)
+	s.docs[docId] = stored
+	return nil
+}
+
+// Compares the doc as marshalled by encoding/json, which every doc written
+// to the store also is
+func (s *MemoryStore) Renew(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.begin(OpRenew, docId); err != nil {
+		return false, err
+	}
+	stored, ok := s.lookup(docId)
+	if !ok {
+		return false, cbheartbeat.ErrDocNotFound
+	}
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(stored.value, value) {
+		return false, nil
+	}
+	return true, s.write(docId, doc, ttl)
+}
+
+// Nothing to prepare, every query scans every doc
+func (s *MemoryStore) PrepareHeartbeatQuery(heartbeatDocType string) error {
+	return nil
+}
+
+// Like a view queried with stale=false, sees every write made before it
+func (s *MemoryStore) QueryHeartbeatDocs(heartbeatDocType, docIdPrefix string) ([]json.RawMessage, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.begin(OpQuery, docIdPrefix); err != nil {
+		return nil, err
+	}
+
+	docIds := []string{}
+	for docId := range s.docs {
+		if strings.HasPrefix(docId, docIdPrefix) {
+			docIds = append(docIds, docId)
+		}
+	}
+	sort.Strings(docIds)
+
+	heartbeatDocs := []json.RawMessage{}
+	for _, docId := range docIds {
+		stored, ok := s.lookup(docId)
+		if !ok {
+			continue
+		}
+		typed := struct {
+			Type string `json:"type"`
+		}{}
+		if err := json.Unmarshal(stored.value, &typed); err != nil || typed.Type != heartbeatDocType {
+			continue
+		}
+		heartbeatDocs = append(heartbeatDocs, stored.value)
+	}
+	return heartbeatDocs, nil
+
+}
+
+// Does nothing, since the store may be shared by several heartbeaters
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Count the operation and return the injected failure, if any.  Must be
+// called with the mutex held.
+func (s *MemoryStore) begin(op, docId string) error {
+	s.ops[op]++
+	if s.failure == nil {
+		return nil
+	}
+	return s.failure(op, docId)
+}
+
+// Return the doc unless it doesn't exist or has expired, in which case it
+// is also removed.  Must be called with the mutex held.
+func (s *MemoryStore) lookup(docId string) (memoryDoc, bool) {
+	stored, ok := s.docs[docId]
+	if !ok {
+		return memoryDoc{}, false
+	}
+	if !stored.expiresAt.IsZero() && !s.clock.Now().Before(stored.expiresAt) {
+		delete(s.docs, docId)
+		return memoryDoc{}, false
+	}
+	return stored, true
+}
+
+// Must be called with the mutex held
+func (s *MemoryStore) write(docId string, doc interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	s.docs[docId] = memoryDoc{value: value, expiresAt: s.expiry(ttl)}
+	return nil
+}
+
+func (s *MemoryStore) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return s.clock.Now().Add(ttl)
+}
@@ -0,0 +1,73 @@
+package cbheartbeattest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+)
+
+// How often WaitForStale also checks StaleNodes, in case the stale
+// notification went to another checker, eg with WithSingleNotifier
+const waitForStalePollInterval = 100 * time.Millisecond
+
+// A temporary stale handler which waits for one node
+type staleWaiter struct {
+	nodeUuid string
+	stale    chan struct{}
+	once     sync.Once
+}
+
+func (w *staleWaiter) StaleHeartBeatDetected(nodeUuid string) {
+	if nodeUuid == w.nodeUuid {
+		w.once.Do(func() {
+			close(w.stale)
+		})
+	}
+}
+
+// Block until the heartbeater's checker reports the given node stale, or
+// return an error once timeout has passed, eg in a failover test after
+// stopping the node.  Returns straight away if the node has already been
+// reported stale.  The checker must be running, or be driven by the test
+// from another goroutine, eg with InMemoryHeartbeater.Advance.  Works with
+// any Heartbeater, by adding a stale handler which is removed again before
+// this returns.
+func WaitForStale(h cbheartbeat.Heartbeater, nodeUuid string, timeout time.Duration) error {
+
+	waiter := &staleWaiter{
+		nodeUuid: nodeUuid,
+		stale:    make(chan struct{}),
+	}
+	h.AddStaleHandler(waiter)
+	defer h.RemoveStaleHandler(waiter)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(waitForStalePollInterval)
+	defer poll.Stop()
+
+	for {
+		if isStaleNode(h, nodeUuid) {
+			return nil
+		}
+		select {
+		case <-waiter.stale:
+			return nil
+		case <-poll.C:
+		case <-deadline.C:
+			return fmt.Errorf("Node %v was not reported stale within %v", nodeUuid, timeout)
+		}
+	}
+
+}
+
+func isStaleNode(h cbheartbeat.Heartbeater, nodeUuid string) bool {
+	for _, staleNode := range h.StaleNodes() {
+		if staleNode == nodeUuid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+// Package cbotel adapts an OpenTelemetry tracer to a cbheartbeat.Tracer, so
+// that only users who want tracing need to depend on OpenTelemetry.
+package cbotel
+
+import (
+	"context"
+
+	"github.com/tleyden/cb-heartbeat"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Wrap an OpenTelemetry tracer, eg otel.Tracer("cbheartbeat"), for passing
+// to cbheartbeat.WithTracer
+func NewTracer(tracer trace.Tracer) cbheartbeat.Tracer {
+	return otelTracer{tracer: tracer}
+}
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) Start(ctx context.Context, spanName string, attributes map[string]string) (context.Context, cbheartbeat.Span) {
+	attrs := make([]attribute.KeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		attrs = append(attrs, attribute.String(key, value))
+	}
+	ctx, span := t.tracer.Start(ctx, spanName, trace.WithAttributes(attrs...))
+	return ctx, otelSpan{span: span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
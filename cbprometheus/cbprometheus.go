@@ -0,0 +1,128 @@
+// Package cbprometheus exports cb-heartbeat activity as Prometheus metrics.
+// It lives in its own package so that the core library doesn't depend on
+// the Prometheus client.
+package cbprometheus
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tleyden/cb-heartbeat"
+)
+
+// Metrics is both a cbheartbeat.MetricsRecorder, to be passed to
+// cbheartbeat.WithMetrics, and a prometheus.Collector, to be registered
+// with a Prometheus registry.
+type Metrics struct {
+	heartbeatsSent  prometheus.Counter
+	sendFailures    prometheus.Counter
+	staleDetections prometheus.Counter
+	checkDuration   prometheus.Histogram
+	liveNodes       prometheus.Gauge
+	viewDuration    *prometheus.HistogramVec
+	viewFailures    *prometheus.CounterVec
+}
+
+var _ cbheartbeat.MetricsRecorder = &Metrics{}
+var _ cbheartbeat.ViewMetricsRecorder = &Metrics{}
+var _ prometheus.Collector = &Metrics{}
+
+// Create a new set of metrics, with names prefixed by the given namespace
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		heartbeatsSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "heartbeat",
+			Name:      "sent_total",
+			Help:      "Number of heartbeats successfully sent.",
+		}),
+		sendFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "heartbeat",
+			Name:      "send_failures_total",
+			Help:      "Number of heartbeats that failed to send.",
+		}),
+		staleDetections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "heartbeat",
+			Name:      "stale_detections_total",
+			Help:      "Number of times another node was detected to have stopped sending heartbeats.",
+		}),
+		checkDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "heartbeat",
+			Name:      "check_duration_seconds",
+			Help:      "How long each check for stale heartbeats took.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		liveNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "heartbeat",
+			Name:      "live_nodes",
+			Help:      "Number of other nodes found alive by the last check.",
+		}),
+		viewDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "heartbeat",
+			Name:      "view_query_duration_seconds",
+			Help:      "How long each query of the heartbeat view took.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"design_doc", "view"}),
+		viewFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "heartbeat",
+			Name:      "view_query_failures_total",
+			Help:      "Number of queries of the heartbeat view that failed.",
+		}, []string{"design_doc", "view"}),
+	}
+}
+
+func (m *Metrics) HeartbeatSent(err error) {
+	if err != nil {
+		m.sendFailures.Inc()
+		return
+	}
+	m.heartbeatsSent.Inc()
+}
+
+func (m *Metrics) StaleNodeDetected(nodeUuid string) {
+	m.staleDetections.Inc()
+}
+
+func (m *Metrics) CheckCompleted(duration time.Duration, liveNodes int, err error) {
+	m.checkDuration.Observe(duration.Seconds())
+	if err == nil {
+		m.liveNodes.Set(float64(liveNodes))
+	}
+}
+
+func (m *Metrics) ViewQueried(designDocName, viewName string, duration time.Duration, err error) {
+	m.viewDuration.WithLabelValues(designDocName, viewName).Observe(duration.Seconds())
+	if err != nil {
+		m.viewFailures.WithLabelValues(designDocName, viewName).Inc()
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.heartbeatsSent,
+		m.sendFailures,
+		m.staleDetections,
+		m.checkDuration,
+		m.liveNodes,
+		m.viewDuration,
+		m.viewFailures,
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
@@ -0,0 +1,58 @@
+package cbheartbeat
+
+import "time"
+
+// A Clock tells the time and makes tickers and timers.  The sender and
+// checker use it for their schedules and for the timestamps in heartbeat
+// docs, so that tests can control time with a fake clock (see
+// cbheartbeattest.FakeClock) rather than sleeping.  Doc expiry is still up
+// to Couchbase Server and its own clock.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// The subset of *time.Ticker used by the checker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// The subset of *time.Timer used by the sender
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// The default Clock, which is just the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
@@ -0,0 +1,95 @@
+package cbheartbeat
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Controls the exact JSON written for heartbeat and timeout docs, see
+// WithDocCodec.  Whatever EncodeHeartbeatDoc returns must still have a
+// top-level "type" field set to the doc's Type, since that's what the view
+// and N1QL query select heartbeat docs by.
+type DocCodec interface {
+
+	// Return the value to write for a heartbeat doc, which will be
+	// marshalled with encoding/json, eg a struct or a json.RawMessage
+	EncodeHeartbeatDoc(doc HeartbeatDoc) (interface{}, error)
+
+	// Parse a heartbeat doc written by EncodeHeartbeatDoc, possibly by
+	// another node.  At least NodeUUID must be set, the rest can be left
+	// zero if unknown.
+	DecodeHeartbeatDoc(raw []byte) (HeartbeatDoc, error)
+
+	// Return the value to write for a heartbeat timeout doc.  Only its
+	// existence matters to checkers, so it's never decoded.
+	EncodeTimeoutDoc(doc TimeoutDoc) (interface{}, error)
+}
+
+// The contents of a heartbeat doc, as passed to a DocCodec
+type HeartbeatDoc struct {
+	Type string // the heartbeat doc type, see WithDocTypePrefix
+	NodeInfo
+	Minimal bool // only rewritten when it changes, see WithMinimalWrites
+}
+
+// The contents of a heartbeat timeout doc, as passed to a DocCodec
+type TimeoutDoc struct {
+	Type     string
+	NodeUUID string
+}
+
+func (m heartbeatMeta) heartbeatDoc() HeartbeatDoc {
+	return HeartbeatDoc{
+		Type:     m.Type,
+		NodeInfo: m.nodeInfo(),
+		Minimal:  m.Minimal,
+	}
+}
+
+func newHeartbeatMeta(doc HeartbeatDoc) heartbeatMeta {
+	meta := heartbeatMeta{
+		Type:      doc.Type,
+		NodeUUID:  doc.NodeUUID,
+		Sequence:  doc.Sequence,
+		TimeoutMs: int64(doc.Timeout / time.Millisecond),
+		Metadata:  doc.Metadata,
+		Minimal:   doc.Minimal,
+	}
+	if !doc.LastSeen.IsZero() {
+		meta.Timestamp = doc.LastSeen.UnixNano() / int64(time.Millisecond)
+	}
+	return meta
+}
+
+// The value to write for the given heartbeat doc, as is unless running with
+// WithDocCodec
+func (h *couchbaseHeartBeater) encodeHeartbeatDoc(meta heartbeatMeta) (interface{}, error) {
+	if h.docCodec == nil {
+		return meta, nil
+	}
+	return h.docCodec.EncodeHeartbeatDoc(meta.heartbeatDoc())
+}
+
+func (h *couchbaseHeartBeater) encodeTimeoutDoc(timeout heartbeatTimeout) (interface{}, error) {
+	if h.docCodec == nil {
+		return timeout, nil
+	}
+	return h.docCodec.EncodeTimeoutDoc(TimeoutDoc{Type: timeout.Type, NodeUUID: timeout.NodeUUID})
+}
+
+func (h *couchbaseHeartBeater) decodeHeartbeatDoc(raw []byte) (heartbeatMeta, error) {
+	if h.docCodec == nil {
+		meta := heartbeatMeta{}
+		err := json.Unmarshal(raw, &meta)
+		return meta, err
+	}
+	doc, err := h.docCodec.DecodeHeartbeatDoc(raw)
+	if err != nil {
+		return heartbeatMeta{}, err
+	}
+	if doc.NodeUUID == "" {
+		return heartbeatMeta{}, fmt.Errorf("DocCodec returned a heartbeat doc without a NodeUUID")
+	}
+	return newHeartbeatMeta(doc), nil
+}
@@ -0,0 +1,99 @@
+package cbheartbeat
+
+import "time"
+
+// The settings a heartbeater is actually running with, after defaults and
+// Options have been applied, see Config.  Settings that depend on the send
+// interval or stale threshold are zero until the sender or checker has been
+// started.
+type HeartbeaterConfig struct {
+	NodeUUID         string
+	KeyPrefix        string
+	HeartbeatDocType string // the "type" field of heartbeat docs
+	Observer         bool   // see WithObserver
+
+	// Sender
+	SendInterval       time.Duration // as passed to StartSendingHeartbeats or SetSendInterval
+	TimeoutMultiplier  float64       // see WithTimeoutMultiplier
+	TimeoutGracePeriod time.Duration // see WithTimeoutGracePeriod
+	TimeoutTTL         time.Duration // how long each heartbeat timeout doc lives, derived from the above
+	HeartbeatDocTTL    time.Duration // how long each heartbeat doc lives, 0 for forever
+	SendRetries        int
+	SendRetryDelay     time.Duration
+	Jitter             float64
+	Durability         Durability
+	MinimalWrites      bool
+	SingleDoc          bool
+
+	// Checker
+	StaleThreshold         time.Duration // as passed to StartCheckingHeartbeats
+	CheckInterval          time.Duration // how often the checker actually runs
+	StaleAfterMissedChecks int
+	PhiThreshold           float64 // 0 if the phi accrual detector is off
+	CheckWorkers           int
+	KeepStaleDocs          bool
+	ReadOnlyChecker        bool
+	SingleNotifier         bool
+	StaleMarkerTTL         time.Duration // 0 if derived from the stale threshold
+	AsyncHandlers          bool
+	StaleHandlerLimit      int // 0 for no limit
+
+	// Default go-couchbase store only, empty for any other Store
+	DesignDocName    string
+	ViewName         string
+	SkipViewCreation bool
+	UseN1QL          bool
+}
+
+// Return the settings this heartbeater is running with, eg to log at startup
+func (h *couchbaseHeartBeater) Config() HeartbeaterConfig {
+
+	sendInterval := h.getSendInterval()
+	config := HeartbeaterConfig{
+		NodeUUID:               h.nodeUuid,
+		KeyPrefix:              h.keyPrefix,
+		HeartbeatDocType:       h.heartbeatDocType,
+		Observer:               h.observer,
+		SendInterval:           sendInterval,
+		TimeoutMultiplier:      h.timeoutMultiplier,
+		TimeoutGracePeriod:     h.timeoutGracePeriod,
+		SendRetries:            h.sendRetries,
+		SendRetryDelay:         h.sendRetryDelay,
+		Jitter:                 h.jitter,
+		Durability:             h.durability,
+		MinimalWrites:          h.minimalWrites,
+		SingleDoc:              h.singleDoc,
+		StaleAfterMissedChecks: h.staleAfterMissedChecks,
+		PhiThreshold:           h.phiThreshold,
+		CheckWorkers:           h.checkWorkers,
+		KeepStaleDocs:          h.keepStaleDocs,
+		ReadOnlyChecker:        h.readOnlyChecker,
+		SingleNotifier:         h.singleNotifier,
+		StaleMarkerTTL:         h.staleMarkerTTL,
+		AsyncHandlers:          h.asyncHandlers,
+		StaleHandlerLimit:      h.staleHandlerLimit,
+	}
+	if store, ok := h.store.(*couchbaseStore); ok {
+		config.DesignDocName = store.designDocName
+		config.ViewName = store.viewName
+		config.SkipViewCreation = store.skipViewCreation
+		config.UseN1QL = store.getN1QLQueryUrl() != ""
+	}
+	if config.CheckWorkers < 1 {
+		config.CheckWorkers = 1
+	}
+	if sendInterval > 0 {
+		config.TimeoutTTL = h.timeoutTTL(sendInterval)
+		config.HeartbeatDocTTL = h.heartbeatDocTTLFor(sendInterval)
+	}
+
+	h.checkConfigMutex.Lock()
+	checkStarted, staleThreshold := h.checkStarted, h.checkStaleThreshold
+	h.checkConfigMutex.Unlock()
+	if checkStarted {
+		config.StaleThreshold = staleThreshold
+		config.CheckInterval = h.checkIntervalFor(staleThreshold)
+	}
+	return config
+
+}
@@ -0,0 +1,676 @@
+package cbheartbeat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+)
+
+// Appended to a doc id prefix to give the end of a key range which covers
+// every doc id starting with the prefix.  U+10FFFF is the highest code point,
+// so it sorts after any other character both by bytes, as N1QL compares
+// strings, and by Unicode collation, as views do.  escapeNodeUuid escapes it,
+// so that it is never the first character after the prefix.
+const docIdRangeEnd = "\U0010ffff"
+
+// The default Store, which uses a go-couchbase bucket and finds heartbeat
+// docs with either a map-reduce view or N1QL
+type couchbaseStore struct {
+	bucketMutex        sync.Mutex        // guards bucket, lastReconnect, lastConnectAttempt and connectErr
+	bucket             *couchbase.Bucket // nil until connected, or after being invalidated
+	sharedBucket       bool              // passed in by the caller, so never closed or reconnected by us
+	lastReconnect      time.Time         // when the bucket was last invalidated after a connection error
+	lastConnectAttempt time.Time
+	connectErr         error // from the last connection attempt, returned until it is time to try again
+	couchbaseUrlStr    string
+	bucketName         string
+	poolName           string
+	username           string // optional, rather than embedding credentials in the url
+	password           string
+	authHandler        couchbase.AuthHandler // optional, takes precedence over username and password
+	keyPrefix          string
+	docId              func(kind, nodeUuid string) string // the heartbeater's, see WithDocIdFunc
+	logger             Logger
+	metrics            MetricsRecorder
+	designDocName      string
+	viewName           string
+	viewMutex          sync.Mutex // guards viewPublished
+	viewPublished      time.Time  // when this store last wrote the design doc, zero if it didn't
+	skipViewCreation   bool       // the view was created by an admin, see WithSkipViewCreation
+	n1qlMutex          sync.Mutex // guards n1qlQueryUrl, which is cleared if N1QL turns out not to be available
+	n1qlQueryUrl       string     // if set, use N1QL rather than the view, see WithN1QL
+	viewStaleness      ViewStaleness
+	reconnectInterval  time.Duration // minimum time between bucket reconnection attempts
+	operationTimeout   time.Duration // abandon a bucket operation after this long, 0 for no limit
+	connectRetries     int           // retries for the initial connection, see WithConnectRetry
+	connectRetryDelay  time.Duration // delay before the first retry, doubled after each one
+	connectTimeout     time.Duration // give up retrying after this long, 0 for no limit
+	viewRetryDelay     time.Duration // between queries of a view whose index isn't built yet
+}
+
+func newCouchbaseStore(couchbaseUrl, bucketName string) *couchbaseStore {
+	return &couchbaseStore{
+		couchbaseUrlStr:   couchbaseUrl,
+		bucketName:        bucketName,
+		poolName:          defaultPoolName,
+		logger:            stdLogger{},
+		metrics:           noopMetrics{},
+		designDocName:     defaultDesignDocName,
+		viewName:          defaultViewName,
+		viewStaleness:     StaleFalse,
+		viewRetryDelay:    defaultViewNotReadyRetryDelay,
+		reconnectInterval: defaultReconnectInterval,
+		operationTimeout:  defaultOperationTimeout,
+	}
+}
+
+func (s *couchbaseStore) Upsert(docId string, doc interface{}, ttl time.Duration) error {
+	bucket, err := s.getBucket()
+	if err != nil {
+		return err
+	}
+	return s.checkErr(s.withTimeout("Set", func() error {
+		return bucket.Set(docId, couchbaseExpiry(ttl), doc)
+	}))
+}
+
+func (s *couchbaseStore) Insert(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+	bucket, err := s.getBucket()
+	if err != nil {
+		return false, err
+	}
+	added := false
+	err = s.withTimeout("Add", func() error {
+		var err error
+		added, err = bucket.Add(docId, couchbaseExpiry(ttl), doc)
+		return err
+	})
+	if err != nil {
+		return false, s.checkErr(err)
+	}
+	return added, nil
+}
+
+func (s *couchbaseStore) Get(docId string, doc interface{}) error {
+	bucket, err := s.getBucket()
+	if err != nil {
+		return err
+	}
+	// get the raw JSON, so that an abandoned Get can't write to doc later
+	var raw json.RawMessage
+	err = s.withTimeout("Get", func() error {
+		return bucket.Get(docId, &raw)
+	})
+	if err != nil {
+		return s.checkErr(err)
+	}
+	return json.Unmarshal(raw, doc)
+}
+
+func (s *couchbaseStore) GetBulk(docIds []string) (map[string]json.RawMessage, error) {
+	bucket, err := s.getBucket()
+	if err != nil {
+		return nil, err
+	}
+	var rawDocs map[string][]byte
+	err = s.withTimeout("GetBulkRaw", func() error {
+		var err error
+		rawDocs, err = bucket.GetBulkRaw(docIds)
+		return err
+	})
+	if err != nil {
+		return nil, s.checkErr(err)
+	}
+	docs := make(map[string]json.RawMessage, len(rawDocs))
+	for docId, rawDoc := range rawDocs {
+		docs[docId] = rawDoc
+	}
+	return docs, nil
+}
+
+func (s *couchbaseStore) Delete(docId string) error {
+	bucket, err := s.getBucket()
+	if err != nil {
+		return err
+	}
+	return s.checkErr(s.withTimeout("Delete", func() error {
+		return bucket.Delete(docId)
+	}))
+}
+
+// Read the doc with its CAS, and only write it back if the CAS hasn't
+// changed.  Docs are always written as marshalled by encoding/json, so the
+// same doc has the same bytes.
+func (s *couchbaseStore) Renew(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+
+	bucket, err := s.getBucket()
+	if err != nil {
+		return false, err
+	}
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+
+	var current json.RawMessage
+	var cas uint64
+	err = s.withTimeout("Gets", func() error {
+		return bucket.Gets(docId, &current, &cas)
+	})
+	if err != nil {
+		return false, s.checkErr(err)
+	}
+	if !bytes.Equal(current, value) {
+		return false, nil
+	}
+
+	err = s.withTimeout("Cas", func() error {
+		_, err := bucket.Cas(docId, couchbaseExpiry(ttl), cas, doc)
+		return err
+	})
+	if couchbase.IsKeyEExistsError(err) {
+		// written by someone else since the Gets
+		return false, nil
+	}
+	if err != nil {
+		return false, s.checkErr(err)
+	}
+	return true, nil
+
+}
+
+func (s *couchbaseStore) Touch(docId string, ttl time.Duration) error {
+	bucket, err := s.getBucket()
+	if err != nil {
+		return err
+	}
+	return s.checkErr(s.withTimeout("Touch", func() error {
+		return bucket.Touch(docId, couchbaseExpiry(ttl))
+	}))
+}
+
+// Create whatever QueryHeartbeatDocs needs, ie either the N1QL index or the
+// view.  If the N1QL index can't be created because the query service isn't
+// available, fall back to the view.
+func (s *couchbaseStore) PrepareHeartbeatQuery(heartbeatDocType string) error {
+
+	if s.getN1QLQueryUrl() != "" {
+		err := s.addHeartbeatCheckIndex(heartbeatDocType)
+		if err == nil {
+			return nil
+		}
+		s.logger.Printf("Error creating N1QL index, falling back to view: %v", err)
+		s.n1qlMutex.Lock()
+		s.n1qlQueryUrl = ""
+		s.n1qlMutex.Unlock()
+	}
+	if s.skipViewCreation {
+		return nil
+	}
+	return s.checkErr(s.addHeartbeatCheckView(heartbeatDocType))
+
+}
+
+// The url of the N1QL query service, or "" to use the view
+func (s *couchbaseStore) getN1QLQueryUrl() string {
+	s.n1qlMutex.Lock()
+	defer s.n1qlMutex.Unlock()
+	return s.n1qlQueryUrl
+}
+
+// Get all heartbeat docs, using either N1QL or the view
+func (s *couchbaseStore) QueryHeartbeatDocs(heartbeatDocType, docIdPrefix string) ([]json.RawMessage, error) {
+	if s.getN1QLQueryUrl() != "" {
+		return s.n1qlQueryHeartbeatDocs(heartbeatDocType, docIdPrefix)
+	}
+	heartbeatDocs, err := s.viewQueryHeartbeatDocs(docIdPrefix)
+	return heartbeatDocs, s.checkErr(err)
+}
+
+// Close the bucket, unless it is shared with the caller
+func (s *couchbaseStore) Close() error {
+	s.bucketMutex.Lock()
+	defer s.bucketMutex.Unlock()
+	s.invalidateBucket()
+	s.bucket = nil
+	return nil
+}
+
+// Translate go-couchbase errors into the ones the Store interface promises,
+// and reconnect if the connection looks broken
+func (s *couchbaseStore) checkErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if couchbase.IsKeyNoEntError(err) {
+		return ErrDocNotFound
+	}
+	s.reconnectIfNeeded(err)
+	return err
+}
+
+func (s *couchbaseStore) viewQueryHeartbeatDocs(docIdPrefix string) ([]json.RawMessage, error) {
+
+	rows, err := s.viewQueryRows(docIdPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeats := []json.RawMessage{}
+	for _, row := range rows {
+		heartbeats = append(heartbeats, row.Value)
+	}
+
+	return heartbeats, nil
+
+}
+
+func (s *couchbaseStore) QueryHeartbeatView(docIdPrefix string) ([]HeartbeatViewRow, error) {
+	if s.getN1QLQueryUrl() != "" {
+		return nil, ErrNoView
+	}
+	rows, err := s.viewQueryRows(docIdPrefix)
+	return rows, s.checkErr(err)
+}
+
+// The view is keyed by doc id, so only the rows for docs whose id starts
+// with docIdPrefix are read.  Right after the design doc is published, the
+// view index may not be built yet, which is retried for a while and then
+// treated as there being no heartbeats yet, rather than failing the check.
+func (s *couchbaseStore) viewQueryRows(docIdPrefix string) ([]HeartbeatViewRow, error) {
+	return s.retryViewNotReady(func() ([]HeartbeatViewRow, error) {
+		return s.viewQueryRowsOnce(docIdPrefix)
+	})
+}
+
+// Run the view query, retrying it while the view is warming up, see
+// viewQueryRows
+func (s *couchbaseStore) retryViewNotReady(query func() ([]HeartbeatViewRow, error)) ([]HeartbeatViewRow, error) {
+
+	for attempt := 0; ; attempt++ {
+		rows, err := query()
+		if err != nil && s.skipViewCreation && isViewNotReadyError(err) {
+			return nil, fmt.Errorf("Heartbeat view %v/%v not found, it must be created by an admin when running with WithSkipViewCreation: %v",
+				s.designDocName, s.viewName, err)
+		}
+		if err == nil || !isViewNotReadyError(err) || !s.viewWarmingUp() {
+			return rows, err
+		}
+		if attempt >= viewNotReadyRetries {
+			s.logger.Printf("View %v/%v not ready yet, assuming no heartbeats: %v", s.designDocName, s.viewName, err)
+			return []HeartbeatViewRow{}, nil
+		}
+		time.Sleep(s.viewRetryDelay)
+	}
+
+}
+
+// Whether the design doc was published recently enough that its view index
+// may still be building
+func (s *couchbaseStore) viewWarmingUp() bool {
+	s.viewMutex.Lock()
+	defer s.viewMutex.Unlock()
+	return !s.viewPublished.IsZero() && time.Since(s.viewPublished) < viewWarmupPeriod
+}
+
+// Whether a view query failed because the view or its index isn't there
+// yet, which Couchbase Server answers with a 404, whether the reason is
+// "missing" or "missing_named_view"
+func isViewNotReadyError(err error) bool {
+	return httpStatus(err) == http.StatusNotFound
+}
+
+func (s *couchbaseStore) viewQueryRowsOnce(docIdPrefix string) ([]HeartbeatViewRow, error) {
+
+	viewRes := struct {
+		Rows []struct {
+			Id    string
+			Value json.RawMessage
+		}
+		Errors []couchbase.ViewError
+	}{}
+
+	bucket, err := s.getBucket()
+	if err != nil {
+		return nil, err
+	}
+
+	params := viewKeyRange(docIdPrefix)
+	params["stale"] = string(s.viewStaleness)
+	queryStart := time.Now()
+	err = s.withTimeout("ViewCustom", func() error {
+		return bucket.ViewCustom(s.designDocName, s.viewName, params, &viewRes)
+	})
+	if viewMetrics, ok := s.metrics.(ViewMetricsRecorder); ok {
+		viewMetrics.ViewQueried(s.designDocName, s.viewName, time.Since(queryStart), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []HeartbeatViewRow{}
+	for _, row := range viewRes.Rows {
+		rows = append(rows, HeartbeatViewRow{Id: row.Id, Value: row.Value})
+	}
+
+	return rows, nil
+
+}
+
+// The view query params for the rows whose key, the doc id, starts with
+// docIdPrefix.  go-couchbase puts quotes around string params without
+// escaping them, so the keys are passed as JSON, which it leaves as it is.
+func viewKeyRange(docIdPrefix string) map[string]interface{} {
+	startKey, _ := json.Marshal(docIdPrefix)
+	endKey, _ := json.Marshal(docIdPrefix + docIdRangeEnd)
+	return map[string]interface{}{
+		"startkey": json.RawMessage(startKey),
+		"endkey":   json.RawMessage(endKey),
+	}
+}
+
+// Stored under the version key, to tell whether the design doc is up to date
+type viewMarker struct {
+	Type string `json:"type"`
+	Hash string `json:"hash"` // sha256 of the design doc JSON
+}
+
+// Create the heartbeat view, which indexes docs of the given type.  The
+// view is only written if its hash differs from the one stored under the
+// version key, so any change to it, whether to the map function or doc
+// type, is published without a version number to bump.  The version key is
+// per view, and any other views in the design doc are kept, so heartbeaters
+// which share a design doc but use different view names leave each other's
+// views alone.
+func (s *couchbaseStore) addHeartbeatCheckView(heartbeatDocType string) error {
+
+	ddocVersionKey := s.docId(DocKindDesignDocVersion, s.designDocName+"/"+s.viewName)
+
+	// a JSON string is also a valid javascript string literal
+	docTypeLiteral, err := json.Marshal(heartbeatDocType)
+	if err != nil {
+		return err
+	}
+	// keyed by doc id, which starts with the key prefix, so that
+	// viewQueryHeartbeatDocs can read just the rows for its own prefix
+	mapFunction := fmt.Sprintf("function (doc, meta) { if (doc.type == %s) { emit(meta.id, doc); }}", docTypeLiteral)
+	view := map[string]string{
+		"map": mapFunction,
+	}
+	viewJSON, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(viewJSON)
+	hash := hex.EncodeToString(sum[:])
+
+	marker := viewMarker{}
+	err = s.Get(ddocVersionKey, &marker)
+	if err != nil && err != ErrDocNotFound {
+		return err
+	}
+	if marker.Hash == hash {
+		return nil
+	}
+
+	bucket, err := s.getBucket()
+	if err != nil {
+		return err
+	}
+	designDoc, err := s.mergeDesignDoc(bucket, view)
+	if err != nil {
+		return err
+	}
+	s.logger.Printf("Updating view %v/%v", s.designDocName, s.viewName)
+	if err := s.checkErr(bucket.PutDDoc(s.designDocName, designDoc)); err != nil {
+		return err
+	}
+	s.viewMutex.Lock()
+	s.viewPublished = time.Now()
+	s.viewMutex.Unlock()
+	return s.Upsert(ddocVersionKey, viewMarker{Type: "ddocVersion", Hash: hash}, 0)
+
+}
+
+// Return the design doc with the heartbeat view added, or replaced if it is
+// already there, and any other views in it left as they are.  PutDDoc
+// replaces the whole design doc, so it has to be read first.
+func (s *couchbaseStore) mergeDesignDoc(bucket *couchbase.Bucket, view map[string]string) (map[string]interface{}, error) {
+
+	designDoc := map[string]interface{}{}
+	if err := bucket.GetDDoc(s.designDocName, &designDoc); err != nil && !isDesignDocNotFound(err) {
+		return nil, s.checkErr(err)
+	}
+	return addView(designDoc, s.viewName, view), nil
+
+}
+
+// Add the view to the design doc, as read with GetDDoc, replacing any view
+// of the same name
+func addView(designDoc map[string]interface{}, viewName string, view map[string]string) map[string]interface{} {
+	views, _ := designDoc["views"].(map[string]interface{})
+	if views == nil {
+		views = map[string]interface{}{}
+	}
+	views[viewName] = view
+	designDoc["views"] = views
+	return designDoc
+}
+
+func isDesignDocNotFound(err error) bool {
+	return httpStatus(err) == http.StatusNotFound
+}
+
+// The HTTP status of a failed go-couchbase REST request, eg for a design
+// doc, or 0 if err isn't from one
+func httpStatus(err error) int {
+	var httpErr *couchbase.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Status
+	}
+	return 0
+}
+
+// Convert a ttl into a Couchbase expiry in whole seconds, where zero means
+// never expire.  Non-zero ttls are rounded up, so sub-second ttls are never
+// truncated down to zero.
+func couchbaseExpiry(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+// Get the bucket, connecting to it first if needed.  Safe to call from
+// multiple goroutines; the bucket field must not be accessed directly.  If
+// connecting fails, the error is returned without trying again until
+// reconnectInterval has passed, so that every operation doesn't re-dial a
+// cluster that is down.
+func (s *couchbaseStore) getBucket() (*couchbase.Bucket, error) {
+	s.bucketMutex.Lock()
+	defer s.bucketMutex.Unlock()
+	if s.bucket != nil {
+		return s.bucket, nil
+	}
+	if s.connectErr != nil && time.Since(s.lastConnectAttempt) < s.reconnectInterval {
+		return nil, s.connectErr
+	}
+	s.lastConnectAttempt = time.Now()
+	bucket, err := s.connectBucket()
+	s.connectErr = err
+	if err != nil {
+		return nil, err
+	}
+	s.bucket = bucket
+	return bucket, nil
+}
+
+// Connect to the bucket, or return a ConnectError
+func (s *couchbaseStore) connect() error {
+	if err := s.connectWithRetry(); err != nil {
+		return &ConnectError{
+			Url:        redactUrl(s.couchbaseUrlStr),
+			PoolName:   s.poolName,
+			BucketName: s.bucketName,
+			Err:        err,
+		}
+	}
+	return nil
+}
+
+// Connect to the bucket for the first time, retrying with backoff as
+// configured by WithConnectRetry, so that a service can start before
+// Couchbase Server is ready.  Returns the last error if it gives up.
+func (s *couchbaseStore) connectWithRetry() error {
+
+	deadline := time.Now().Add(s.connectTimeout)
+	delay := s.connectRetryDelay
+	for attempt := 0; ; attempt++ {
+
+		// don't let getBucket hand back the previous attempt's error
+		s.bucketMutex.Lock()
+		s.connectErr = nil
+		s.bucketMutex.Unlock()
+
+		_, err := s.getBucket()
+		if err == nil || attempt >= s.connectRetries {
+			return err
+		}
+		if s.connectTimeout > 0 && time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		s.logger.Printf("Error connecting to bucket %v, retrying in %v: %v", s.bucketName, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+
+	}
+
+}
+
+// Close and forget the cached bucket, so that the next getBucket connects
+// again.  A shared bucket is never closed, and can't be reconnected since
+// we don't know how to connect to it, so that is left to whoever owns it.
+// Must be called with the bucketMutex held.
+func (s *couchbaseStore) invalidateBucket() {
+	if s.bucket == nil || s.sharedBucket {
+		return
+	}
+	s.bucket.Close()
+	s.bucket = nil
+	s.connectErr = nil
+}
+
+// If err looks like the connection to Couchbase has been lost, invalidate
+// the bucket so that the next operation connects again, at most once every
+// reconnectInterval so that we don't hammer a cluster that is restarting
+// or rebalancing.
+func (s *couchbaseStore) reconnectIfNeeded(err error) {
+
+	if !isConnectionError(err) {
+		return
+	}
+	s.bucketMutex.Lock()
+	defer s.bucketMutex.Unlock()
+	if s.bucket == nil || s.sharedBucket || time.Since(s.lastReconnect) < s.reconnectInterval {
+		return
+	}
+	s.lastReconnect = time.Now()
+	s.logger.Printf("Reconnecting to bucket %v after error: %v", s.bucketName, err)
+	s.invalidateBucket()
+
+}
+
+// Does this error mean the connection to Couchbase is broken?
+func isConnectionError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, ErrOperationTimeout)
+}
+
+func (s *couchbaseStore) connectBucket() (*couchbase.Bucket, error) {
+
+	if s.authHandler != nil {
+		client, err := couchbase.ConnectWithAuth(s.couchbaseUrlStr, s.authHandler)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := client.GetPool(s.poolName)
+		if err != nil {
+			return nil, err
+		}
+		return pool.GetBucket(s.bucketName)
+	}
+
+	if s.username == "" {
+		// no explicit credentials, any credentials must be in the url
+		return couchbase.GetBucket(s.couchbaseUrlStr, s.poolName, s.bucketName)
+	}
+
+	client, err := couchbase.ConnectWithAuthCreds(s.couchbaseUrlStr, s.username, s.password)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := client.GetPool(s.poolName)
+	if err != nil {
+		return nil, err
+	}
+	return pool.GetBucketWithAuth(s.bucketName, s.username, s.password)
+
+}
+
+// go-couchbase can only wait for the write to be persisted on the active
+// node, so only DurabilityPersistActive is supported
+func (s *couchbaseStore) UpsertDurable(docId string, doc interface{}, ttl time.Duration, durability Durability) error {
+	switch durability {
+	case DurabilityNone:
+		return s.Upsert(docId, doc, ttl)
+	case DurabilityPersistActive:
+	default:
+		return fmt.Errorf("Durability %v is not supported by go-couchbase, only DurabilityPersistActive", durability)
+	}
+	bucket, err := s.getBucket()
+	if err != nil {
+		return err
+	}
+	return s.checkErr(s.withTimeout("Write", func() error {
+		return bucket.Write(docId, 0, couchbaseExpiry(ttl), doc, couchbase.Persist)
+	}))
+}
+
+// Run a bucket operation, but give up waiting for it after operationTimeout,
+// so that a hung connection can't block the sender or checker forever.  An
+// abandoned operation carries on in the background, so op must only write
+// to variables the caller doesn't read after a timeout.
+func (s *couchbaseStore) withTimeout(opName string, op func() error) error {
+
+	if s.operationTimeout <= 0 {
+		return op()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+
+	timer := time.NewTimer(s.operationTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%v on bucket %v: %w after %v", opName, s.bucketName, ErrOperationTimeout, s.operationTimeout)
+	}
+
+}
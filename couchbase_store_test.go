@@ -0,0 +1,196 @@
+package cbheartbeat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+)
+
+// The default store of a heartbeater created with the given options, without
+// connecting to Couchbase
+func newTestCouchbaseStore(t *testing.T, opts ...Option) *couchbaseStore {
+	t.Helper()
+	store := newCouchbaseStore("http://localhost:8091", "default")
+	opts = append([]Option{WithNodeUUID("a")}, opts...)
+	if _, err := newHeartbeater(store, store, opts); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestDesignDocName(t *testing.T) {
+	if name := newTestCouchbaseStore(t).designDocName; name != defaultDesignDocName {
+		t.Fatalf("default design doc name %q, want %q", name, defaultDesignDocName)
+	}
+	a := newTestCouchbaseStore(t, WithDesignDoc("a"))
+	b := newTestCouchbaseStore(t, WithDesignDoc("b"))
+	if a.designDocName != "a" || b.designDocName != "b" {
+		t.Fatalf("design doc names %q and %q, want a and b", a.designDocName, b.designDocName)
+	}
+}
+
+// Another component's views in the same design doc must survive publishing
+// the heartbeat view
+func TestAddViewKeepsOtherViews(t *testing.T) {
+
+	theirs := map[string]interface{}{"map": "function (doc, meta) { emit(meta.id, null); }"}
+	designDoc := map[string]interface{}{
+		"views": map[string]interface{}{
+			"theirs":     theirs,
+			"heartbeats": map[string]interface{}{"map": "an old version"},
+		},
+	}
+	ours := map[string]string{"map": "a new version"}
+
+	got := addView(designDoc, "heartbeats", ours)
+	want := map[string]interface{}{
+		"views": map[string]interface{}{
+			"theirs":     theirs,
+			"heartbeats": ours,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("addView gave %v, want %v", got, want)
+	}
+
+	got = addView(map[string]interface{}{}, "heartbeats", ours)
+	want = map[string]interface{}{"views": map[string]interface{}{"heartbeats": ours}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("addView to an empty design doc gave %v, want %v", got, want)
+	}
+
+}
+
+// Going by the HTTP status, not whatever the error text happens to contain
+func TestIsDesignDocNotFound(t *testing.T) {
+	notFound := &couchbase.HTTPError{Status: 404, Body: []byte(`{"error":"not_found","reason":"missing"}`)}
+	if !isDesignDocNotFound(fmt.Errorf("GetDDoc: %w", notFound)) {
+		t.Error("a 404 wasn't taken to mean the design doc is missing")
+	}
+	for _, err := range []error{
+		&couchbase.HTTPError{Status: 500, Body: []byte("error 404")},
+		errors.New("dial tcp 10.0.0.1:404: connection refused"),
+	} {
+		if isDesignDocNotFound(err) {
+			t.Errorf("%v was taken to mean the design doc is missing", err)
+		}
+	}
+}
+
+func TestCouchbaseExpiry(t *testing.T) {
+	for ttl, want := range map[time.Duration]int{
+		0:                       0,
+		300 * time.Millisecond:  1,
+		600 * time.Millisecond:  1,
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		time.Minute:             60,
+	} {
+		if got := couchbaseExpiry(ttl); got != want {
+			t.Errorf("couchbaseExpiry(%v) = %v, want %v", ttl, got, want)
+		}
+	}
+}
+
+func TestPoolName(t *testing.T) {
+	if name := newTestCouchbaseStore(t).poolName; name != "default" {
+		t.Fatalf("default pool name %q, want default", name)
+	}
+	if name := newTestCouchbaseStore(t, WithPoolName("custom")).poolName; name != "custom" {
+		t.Fatalf("pool name %q, want custom", name)
+	}
+}
+
+// A view query which fails as if the view index isn't built yet, until it
+// has been called notReadyFor times
+type warmingUpView struct {
+	notReadyFor int
+	calls       int
+}
+
+func (v *warmingUpView) query() ([]HeartbeatViewRow, error) {
+	v.calls++
+	if v.calls <= v.notReadyFor {
+		return nil, &couchbase.HTTPError{Status: 404, Body: []byte(`{"error":"not_found","reason":"missing"}`)}
+	}
+	return []HeartbeatViewRow{{Id: "heartbeat:a"}}, nil
+}
+
+// A store which has just published the heartbeat view
+func newWarmingUpStore(t *testing.T, opts ...Option) *couchbaseStore {
+	t.Helper()
+	store := newTestCouchbaseStore(t, opts...)
+	store.viewPublished = time.Now()
+	store.viewRetryDelay = time.Millisecond
+	return store
+}
+
+func TestViewBecomesReady(t *testing.T) {
+	view := &warmingUpView{notReadyFor: viewNotReadyRetries}
+	rows, err := newWarmingUpStore(t).retryViewNotReady(view.query)
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("got %v, %v, want the row once the view was ready", rows, err)
+	}
+	if view.calls != viewNotReadyRetries+1 {
+		t.Fatalf("queried %v times, want %v", view.calls, viewNotReadyRetries+1)
+	}
+}
+
+// Treated as no heartbeats yet, rather than an error
+func TestViewNeverReady(t *testing.T) {
+	view := &warmingUpView{notReadyFor: viewNotReadyRetries + 1}
+	rows, err := newWarmingUpStore(t).retryViewNotReady(view.query)
+	if err != nil || len(rows) != 0 {
+		t.Fatalf("got %v, %v, want no rows and no error", rows, err)
+	}
+}
+
+func TestViewNotReadyAfterWarmup(t *testing.T) {
+
+	// published long enough ago that it should have been built
+	store := newWarmingUpStore(t)
+	store.viewPublished = time.Now().Add(-viewWarmupPeriod)
+	view := &warmingUpView{notReadyFor: 1}
+	if _, err := store.retryViewNotReady(view.query); err == nil || view.calls != 1 {
+		t.Fatalf("got error %v after %v queries, want an error straight away", err, view.calls)
+	}
+
+	// not published by us, so there's no telling when it might be ready
+	view = &warmingUpView{notReadyFor: 1}
+	if _, err := newTestCouchbaseStore(t).retryViewNotReady(view.query); err == nil || view.calls != 1 {
+		t.Fatalf("got error %v after %v queries, want an error straight away", err, view.calls)
+	}
+
+	view = &warmingUpView{notReadyFor: 1}
+	_, err := newWarmingUpStore(t, WithSkipViewCreation(true)).retryViewNotReady(view.query)
+	if err == nil || !strings.Contains(err.Error(), "WithSkipViewCreation") {
+		t.Fatalf("got error %v, want one explaining the view must be created by an admin", err)
+	}
+
+}
+
+// The keys must be valid JSON whatever the prefix, and cover every doc id
+// starting with it
+func TestViewKeyRange(t *testing.T) {
+	for _, docIdPrefix := range []string{"heartbeat:", `app"1\:heartbeat:`} {
+		var startKey, endKey string
+		params := viewKeyRange(docIdPrefix)
+		if err := json.Unmarshal(params["startkey"].(json.RawMessage), &startKey); err != nil || startKey != docIdPrefix {
+			t.Fatalf("startkey %s (%v), want %q", params["startkey"], err, docIdPrefix)
+		}
+		if err := json.Unmarshal(params["endkey"].(json.RawMessage), &endKey); err != nil {
+			t.Fatalf("endkey %s: %v", params["endkey"], err)
+		}
+		for _, nodeUuid := range []string{"a", "\uffff", "\U0001f600", "\U0010ffff"} {
+			if docId := docIdPrefix + escapeNodeUuid(nodeUuid); docId >= endKey {
+				t.Errorf("doc id %q is outside the range %q to %q", docId, startKey, endKey)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cbheartbeat
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Returned by CheckNow when the checker hasn't been started
+var ErrCheckerNotStarted = errors.New("cbheartbeat: the heartbeat checker hasn't been started")
+
+// Returned by StartSendingHeartbeats when running with WithObserver
+var ErrObserver = errors.New("cbheartbeat: observers can't send heartbeats")
+
+// Returned, wrapped, by the default store when a Couchbase Server operation
+// doesn't complete within the timeout set by WithOperationTimeout
+var ErrOperationTimeout = errors.New("cbheartbeat: operation timed out")
+
+// Returned by QueryHeartbeatView when the Store doesn't find heartbeat docs
+// with a view, eg when running with WithN1QL
+var ErrNoView = errors.New("cbheartbeat: heartbeat docs aren't found with a view")
+
+// Returned by StartSendingHeartbeats and StartCheckingHeartbeats when the
+// sender or checker is already running
+var ErrAlreadyRunning = errors.New("cbheartbeat: already running")
+
+// Returned by NewCouchbaseHeartbeater and NewCouchbaseHeartbeaterWithOptions
+// when they can't connect to the bucket, eg because Couchbase Server isn't
+// ready yet.  Use errors.As to get at it, and errors.Is / errors.As on it to
+// get at the underlying go-couchbase error.
+type ConnectError struct {
+	Url        string // with any password removed
+	PoolName   string
+	BucketName string
+	Err        error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("Could not connect to bucket %v in pool %v at %v: %v", e.BucketName, e.PoolName, e.Url, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Remove any password from the url, so that it is safe to log
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.User == nil {
+		return rawUrl
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// The operation that a HeartbeatError came from
+type Operation string
+
+const (
+	OpSend   Operation = "send"   // writing this node's heartbeat docs
+	OpCheck  Operation = "check"  // checking other nodes for stale heartbeats
+	OpDelete Operation = "delete" // deleting a stale node's heartbeat doc
+
+	OpLeaderElection Operation = "leader election" // claiming, renewing or releasing the leader doc
+)
+
+// Sent on the channel returned by Errors when the sender or checker
+// goroutines hit an error, tagged with the operation that failed.  Use
+// errors.Is / errors.As on it to get at the underlying error.
+type HeartbeatError struct {
+	Op       Operation
+	NodeUUID string // the node the operation was for, if any
+	Err      error
+}
+
+func (e *HeartbeatError) Error() string {
+	if e.NodeUUID == "" {
+		return fmt.Sprintf("Heartbeat %v failed: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("Heartbeat %v failed for node %v: %v", e.Op, e.NodeUUID, e.Err)
+}
+
+func (e *HeartbeatError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,23 @@
+module github.com/tleyden/cb-heartbeat
+
+go 1.21
+
+require (
+	github.com/couchbase/go-couchbase v0.1.1
+	github.com/couchbase/gocb/v2 v2.8.1
+	github.com/couchbase/gomemcached v0.1.4
+	github.com/prometheus/client_golang v1.19.1
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	github.com/stretchr/testify v1.9.0 // indirect
+	golang.org/x/sys v0.19.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
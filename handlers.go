@@ -0,0 +1,207 @@
+package cbheartbeat
+
+// Replace the handler passed to StartCheckingHeartbeatsContext, eg to react
+// differently once the app has finished starting up.  Takes effect from the
+// next check, and a check that is already running keeps calling back the
+// old handler.  nil removes the handler.  Safe to call while the checker is
+// running, including from a handler.
+func (h *couchbaseHeartBeater) SetStaleHandler(handler HeartbeatsStoppedHandler) {
+	h.staleHandlersMutex.Lock()
+	defer h.staleHandlersMutex.Unlock()
+	h.checkHandler = handler
+}
+
+func (h *couchbaseHeartBeater) getStaleHandler() HeartbeatsStoppedHandler {
+	h.staleHandlersMutex.Lock()
+	defer h.staleHandlersMutex.Unlock()
+	return h.checkHandler
+}
+
+// Register another handler to be called back by the heartbeat checker, in
+// addition to the one passed to StartCheckingHeartbeatsContext, so that
+// several subsystems can each be notified about stale nodes.  Handlers are
+// called in the order they were added, after the one passed to Start.  This
+// can be called before or after starting the checker.
+func (h *couchbaseHeartBeater) AddStaleHandler(handler HeartbeatsStoppedHandler) {
+	h.staleHandlersMutex.Lock()
+	defer h.staleHandlersMutex.Unlock()
+	staleHandlers := make([]HeartbeatsStoppedHandler, 0, len(h.staleHandlers)+1)
+	staleHandlers = append(staleHandlers, h.staleHandlers...)
+	h.staleHandlers = append(staleHandlers, handler)
+}
+
+// Unregister a handler added with AddStaleHandler.  Handlers are compared
+// with ==, so they should be pointers or other comparable values.
+func (h *couchbaseHeartBeater) RemoveStaleHandler(handler HeartbeatsStoppedHandler) {
+	h.staleHandlersMutex.Lock()
+	defer h.staleHandlersMutex.Unlock()
+	staleHandlers := []HeartbeatsStoppedHandler{}
+	for _, staleHandler := range h.staleHandlers {
+		if staleHandler != handler {
+			staleHandlers = append(staleHandlers, staleHandler)
+		}
+	}
+	h.staleHandlers = staleHandlers
+}
+
+// The handler passed to Start, if any, followed by the added handlers
+func (h *couchbaseHeartBeater) handlersWith(handler HeartbeatsStoppedHandler) []HeartbeatsStoppedHandler {
+	h.staleHandlersMutex.Lock()
+	defer h.staleHandlersMutex.Unlock()
+	if handler == nil {
+		return h.staleHandlers
+	}
+	return append([]HeartbeatsStoppedHandler{handler}, h.staleHandlers...)
+}
+
+func (h *couchbaseHeartBeater) notifyStale(handler HeartbeatsStoppedHandler, event StaleEvent) {
+	for _, staleHandler := range h.handlersWith(handler) {
+		staleHandler := staleHandler
+		h.callHandler(event.NodeUUID, func() {
+			notifyStaleHeartbeat(staleHandler, event)
+		})
+	}
+}
+
+func (h *couchbaseHeartBeater) notifyRejoined(handler HeartbeatsStoppedHandler, nodeUuid string) {
+	for _, staleHandler := range h.handlersWith(handler) {
+		if resumedHandler, ok := staleHandler.(HeartbeatResumedHandler); ok {
+			h.callHandler(nodeUuid, func() {
+				resumedHandler.NodeRejoined(nodeUuid)
+			})
+		}
+	}
+}
+
+// Call back a handler, either right away or on its own goroutine when
+// running with WithAsyncHandlers
+func (h *couchbaseHeartBeater) callHandler(nodeUuid string, callback func()) {
+	if !h.asyncHandlers {
+		h.callHandlerNow(nodeUuid, callback)
+		return
+	}
+	h.goroutines.Add(1)
+	go func() {
+		defer h.goroutines.Done()
+		h.callHandlerNow(nodeUuid, callback)
+	}()
+}
+
+// Recover from any panic in the handler, so that one misbehaving handler
+// can't kill the checker goroutine or stop the others being called
+func (h *couchbaseHeartBeater) callHandlerNow(nodeUuid string, callback func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.logger.Printf("Recovered from panic in handler for node: %v panic: %v", nodeUuid, r)
+		}
+	}()
+	callback()
+}
+
+func notifyStaleHeartbeat(handler HeartbeatsStoppedHandler, event StaleEvent) {
+	if detailedHandler, ok := handler.(DetailedStaleHandler); ok {
+		detailedHandler.StaleHeartBeatDetectedEvent(event)
+		return
+	}
+	if lastSeenHandler, ok := handler.(HeartbeatsStoppedLastSeenHandler); ok {
+		lastSeenHandler.StaleHeartBeatDetectedLastSeen(event.NodeUUID, event.LastSeen)
+		return
+	}
+	handler.StaleHeartBeatDetected(event.NodeUUID)
+}
+
+// A stale notification held back by WithStaleHandlerLimit, for one handler
+type queuedStaleEvent struct {
+	handler HeartbeatsStoppedHandler
+	event   StaleEvent
+}
+
+// Start a check's allowance of nodes to notify handlers about, see
+// WithStaleHandlerLimit, spending it first on the nodes queued by earlier
+// checks which are still stale
+func (h *couchbaseHeartBeater) beginHandlerBudget() {
+
+	if h.staleHandlerLimit <= 0 {
+		return
+	}
+
+	h.handlerBudgetMutex.Lock()
+	h.handlerBudget = h.staleHandlerLimit
+	queued := h.queuedStale
+	h.queuedStale = nil
+	due := []queuedStaleEvent{}
+	dueNodes := map[string]struct{}{}
+	for _, queuedEvent := range queued {
+		nodeUuid := queuedEvent.event.NodeUUID
+		if !h.isStale(nodeUuid) {
+			// rejoined while it was queued
+			continue
+		}
+		if _, ok := dueNodes[nodeUuid]; !ok {
+			if h.handlerBudget == 0 {
+				h.queuedStale = append(h.queuedStale, queuedEvent)
+				continue
+			}
+			h.handlerBudget--
+			dueNodes[nodeUuid] = struct{}{}
+		}
+		due = append(due, queuedEvent)
+	}
+	h.handlerBudgetMutex.Unlock()
+
+	for _, queuedEvent := range due {
+		queuedEvent := queuedEvent
+		h.callHandler(queuedEvent.event.NodeUUID, func() {
+			notifyStaleHeartbeat(queuedEvent.handler, queuedEvent.event)
+		})
+	}
+
+}
+
+// Whether handlers can be notified about the node straight away, otherwise
+// the node is held back until endHandlerBudget
+func (h *couchbaseHeartBeater) takeHandlerBudget(event StaleEvent) bool {
+	if h.staleHandlerLimit <= 0 {
+		return true
+	}
+	h.handlerBudgetMutex.Lock()
+	defer h.handlerBudgetMutex.Unlock()
+	if h.handlerBudget > 0 {
+		h.handlerBudget--
+		return true
+	}
+	h.overflowStale = append(h.overflowStale, event)
+	return false
+}
+
+// Pass the nodes which were over the limit in this check to each
+// CoalescedStaleHandler in one go, and queue them for the other handlers
+func (h *couchbaseHeartBeater) endHandlerBudget(handler HeartbeatsStoppedHandler) {
+
+	h.handlerBudgetMutex.Lock()
+	overflow := h.overflowStale
+	h.overflowStale = nil
+	h.handlerBudgetMutex.Unlock()
+	if len(overflow) == 0 {
+		return
+	}
+
+	h.logger.Printf("Stale handler limit of %v nodes per check reached, holding back %v more", h.staleHandlerLimit, len(overflow))
+	queued := []queuedStaleEvent{}
+	for _, staleHandler := range h.handlersWith(handler) {
+		if coalescedHandler, ok := staleHandler.(CoalescedStaleHandler); ok {
+			h.callHandler("", func() {
+				coalescedHandler.StaleHeartBeatsCoalesced(overflow)
+			})
+			continue
+		}
+		for _, event := range overflow {
+			queued = append(queued, queuedStaleEvent{handler: staleHandler, event: event})
+		}
+	}
+
+	h.handlerBudgetMutex.Lock()
+	h.queuedStale = append(h.queuedStale, queued...)
+	h.handlerBudgetMutex.Unlock()
+
+}
@@ -0,0 +1,167 @@
+package cbheartbeat
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The leader doc, claimed by whichever node inserts it first, and then
+// renewed by that node's sender for as long as it keeps sending heartbeats
+type heartbeatLeader struct {
+	Type     string `json:"type"`
+	NodeUUID string `json:"node_uuid"`
+}
+
+// Start taking part in leader election, and return a channel which receives
+// true when this node becomes the leader and false when it stops being the
+// leader.  The first node to claim the leader doc becomes the leader, and
+// renews it with every heartbeat.  The leader doc expires with the same TTL
+// as the heartbeat timeout doc, so when the leader is paused, another node
+// takes over once the doc has expired.  When the leader's sender stops, it
+// deletes the leader doc so that another node can take over straight away.
+// If a heartbeat fails, the leader immediately steps down, since it can't be
+// sure it still holds the leader doc.
+//
+// Election runs as part of the heartbeat sender, so the sender must be
+// running.  The channel only holds the latest change, so a slow consumer
+// sees the current state rather than a backlog.  Calling this again returns
+// the same channel.  The leader doc is renewed with compare-and-swap, so the
+// Store must be a CasStore.
+func (h *couchbaseHeartBeater) StartLeaderElection() (<-chan bool, error) {
+
+	if h.observer {
+		return nil, ErrObserver
+	}
+	if _, ok := h.store.(CasStore); !ok {
+		return nil, fmt.Errorf("Store %T doesn't support compare-and-swap, which leader election needs", h.store)
+	}
+	h.leaderMutex.Lock()
+	defer h.leaderMutex.Unlock()
+	if h.leaderChanges == nil {
+		h.leaderChanges = make(chan bool, 1)
+	}
+	return h.leaderChanges, nil
+
+}
+
+// Called by the sender after every heartbeat, with the heartbeat's error
+func (h *couchbaseHeartBeater) runLeaderElection(ctx context.Context, interval time.Duration, sendErr error) {
+
+	h.leaderMutex.Lock()
+	defer h.leaderMutex.Unlock()
+	if h.leaderChanges == nil {
+		// not taking part
+		return
+	}
+
+	isLeader := false
+	if sendErr == nil {
+		var err error
+		isLeader, err = h.claimLeadership(ctx, interval)
+		if err != nil {
+			h.logger.Printf("Error claiming leadership: %v", err)
+			h.sendError(OpLeaderElection, h.nodeUuid, err)
+			isLeader = false
+		}
+	}
+	h.setLeader(isLeader)
+
+}
+
+// Stop being the leader, without deleting the leader doc, eg because
+// sending is paused so it won't be renewed
+func (h *couchbaseHeartBeater) stepDown() {
+	h.leaderMutex.Lock()
+	defer h.leaderMutex.Unlock()
+	if h.leaderChanges != nil {
+		h.setLeader(false)
+	}
+}
+
+// Called when the sender stops, since the leader doc won't be renewed any more
+func (h *couchbaseHeartBeater) stopLeading() {
+	if err := h.releaseLeadership(); err != nil {
+		h.logger.Printf("Error releasing leadership: %v", err)
+		h.sendError(OpLeaderElection, h.nodeUuid, err)
+	}
+}
+
+// Claim or renew the leader doc, and return whether this node holds it
+func (h *couchbaseHeartBeater) claimLeadership(ctx context.Context, interval time.Duration) (bool, error) {
+
+	docId := h.leaderDocId()
+	leaderDoc := heartbeatLeader{
+		Type:     h.leaderDocType,
+		NodeUUID: h.nodeUuid,
+	}
+	ttl := h.timeoutTTL(interval)
+
+	// only renewed if it's still ours, so that if it expired and another
+	// node claimed it in the meantime, we don't take it back
+	renewed := false
+	err := h.trace(ctx, "cbheartbeat.Renew", docId, func(ctx context.Context) error {
+		var err error
+		renewed, err = h.store.(CasStore).Renew(docId, leaderDoc, ttl)
+		return err
+	})
+	if err != ErrDocNotFound {
+		return renewed, err
+	}
+
+	// no leader, so try to become it
+	added := false
+	err = h.trace(ctx, "cbheartbeat.Insert", docId, func(ctx context.Context) error {
+		var err error
+		added, err = h.store.Insert(docId, leaderDoc, ttl)
+		return err
+	})
+	return added, err
+
+}
+
+// Delete the leader doc if this node holds it, so that another node can
+// take over straight away.  Called when the sender stops, and by Deregister.
+func (h *couchbaseHeartBeater) releaseLeadership() error {
+
+	h.leaderMutex.Lock()
+	defer h.leaderMutex.Unlock()
+	if !h.isLeader {
+		return nil
+	}
+	h.setLeader(false)
+	docId := h.leaderDocId()
+	err := h.trace(context.Background(), "cbheartbeat.Delete", docId, func(ctx context.Context) error {
+		return h.store.Delete(docId)
+	})
+	if err != nil && err != ErrDocNotFound {
+		return err
+	}
+	return nil
+
+}
+
+// Record whether this node is the leader, and announce any change.  Must be
+// called with the leaderMutex held.
+func (h *couchbaseHeartBeater) setLeader(isLeader bool) {
+
+	if isLeader == h.isLeader {
+		return
+	}
+	h.isLeader = isLeader
+
+	// only the latest change matters, so replace any unread one.  Nothing
+	// else sends on the channel, so there is then always room.
+	select {
+	case <-h.leaderChanges:
+	default:
+	}
+	h.leaderChanges <- isLeader
+
+}
+
+// There's only one leader doc, so it has no nodeUuid.  Since a nodeUuid can't
+// be empty, this can't collide with the other doc ids.
+func (h *couchbaseHeartBeater) leaderDocId() string {
+	return h.docId(DocKindLeader, "")
+}
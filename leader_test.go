@@ -0,0 +1,139 @@
+package cbheartbeat_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+)
+
+// A heartbeater which is taking part in leader election, and the channel
+// its leadership changes are announced on
+func electingHeartbeater(t *testing.T, c *cluster, nodeUuid string) (cbheartbeat.Heartbeater, <-chan bool) {
+	t.Helper()
+	h := c.heartbeater(nodeUuid)
+	isLeader, err := h.StartLeaderElection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, isLeader
+}
+
+func nextLeaderChange(t *testing.T, isLeader <-chan bool) bool {
+	t.Helper()
+	select {
+	case change := <-isLeader:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a leadership change")
+		return false
+	}
+}
+
+func noLeaderChange(t *testing.T, nodeUuid string, isLeader <-chan bool) {
+	t.Helper()
+	select {
+	case change := <-isLeader:
+		t.Fatalf("%v's leadership changed to %v, want no change", nodeUuid, change)
+	default:
+	}
+}
+
+// When the leader stops sending, it gives up leadership straight away,
+// and the other node takes over with its next heartbeat
+func TestLeaderStepsDownWhenStopped(t *testing.T) {
+
+	c := newCluster(t)
+	a, aIsLeader := electingHeartbeater(t, c, "a")
+	clock := newTimerClock(c.clock)
+	b := c.heartbeater("b", cbheartbeat.WithClock(clock))
+	bIsLeader, err := b.StartLeaderElection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.StartSendingHeartbeatsContext(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !nextLeaderChange(t, aIsLeader) {
+		t.Fatal("a didn't become the leader")
+	}
+	if err := b.StartSendingHeartbeatsContext(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	noLeaderChange(t, "b", bIsLeader)
+
+	a.StopSendingHeartbeats()
+	a.Wait()
+	if nextLeaderChange(t, aIsLeader) {
+		t.Fatal("a is still the leader after stopping")
+	}
+	nextTimer(t, clock)
+	c.clock.Advance(time.Second)
+	if !nextLeaderChange(t, bIsLeader) {
+		t.Fatal("b didn't take over")
+	}
+
+}
+
+// Cancelling the sender's context gives up leadership too
+func TestLeaderStepsDownWhenCancelled(t *testing.T) {
+	c := newCluster(t)
+	h, isLeader := electingHeartbeater(t, c, "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := h.StartSendingHeartbeatsContext(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !nextLeaderChange(t, isLeader) {
+		t.Fatal("a didn't become the leader")
+	}
+	cancel()
+	if nextLeaderChange(t, isLeader) {
+		t.Fatal("a is still the leader after its context was cancelled")
+	}
+}
+
+// A leader whose doc was claimed by another node in the meantime, eg after
+// it expired while the leader was slow, must not renew it
+func TestLeaderDoesntRenewAnotherNodesClaim(t *testing.T) {
+
+	c := newCluster(t)
+	clock := newTimerClock(c.clock)
+	a := c.heartbeater("a", cbheartbeat.WithClock(clock))
+	isLeader, err := a.StartLeaderElection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.StartSendingHeartbeatsContext(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !nextLeaderChange(t, isLeader) {
+		t.Fatal("a didn't become the leader")
+	}
+
+	leaderDocId := cbheartbeat.DocKindLeader + ":"
+	claim := map[string]string{"type": cbheartbeat.DocKindLeader, "node_uuid": "b"}
+	if err := c.store.Upsert(leaderDocId, claim, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	nextTimer(t, clock)
+	c.clock.Advance(time.Second)
+	if nextLeaderChange(t, isLeader) {
+		t.Fatal("a is still the leader after b claimed the leader doc")
+	}
+	leader := map[string]string{}
+	if err := c.store.Get(leaderDocId, &leader); err != nil || leader["node_uuid"] != "b" {
+		t.Fatalf("leader doc %v, %v, want b's claim", leader, err)
+	}
+
+}
+
+// Leader election can't be done safely without compare-and-swap
+func TestLeaderElectionNeedsCasStore(t *testing.T) {
+	c := newCluster(t)
+	h := c.heartbeaterWithStore(struct{ cbheartbeat.Store }{c.store}, "a")
+	if _, err := h.StartLeaderElection(); err == nil {
+		t.Fatal("StartLeaderElection succeeded on a store without compare-and-swap")
+	}
+}
@@ -0,0 +1,16 @@
+package cbheartbeat
+
+import "log"
+
+// A Logger is used to report errors that happen inside the heartbeat sender
+// and checker goroutines, since there is no caller to return them to.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// The default Logger, which writes to the standard library logger
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
@@ -0,0 +1,38 @@
+package cbheartbeat
+
+import "time"
+
+// A MetricsRecorder is told about everything the heartbeat sender and checker
+// do, so that it can be exported to a monitoring system.  See the cbprometheus
+// package for a Prometheus implementation.  Methods are called from the sender
+// and checker goroutines, so implementations must be safe for concurrent use.
+type MetricsRecorder interface {
+
+	// Called after every attempt to send a heartbeat, with the error if it failed
+	HeartbeatSent(err error)
+
+	// Called whenever the checker detects that another node has gone stale
+	StaleNodeDetected(nodeUuid string)
+
+	// Called after every check cycle, with how long it took, how many other
+	// nodes were found to be alive, and the error if it failed
+	CheckCompleted(duration time.Duration, liveNodes int, err error)
+}
+
+// MetricsRecorders that also implement this interface are told how long each
+// query of the heartbeat view took, since with stale=false it is the most
+// expensive part of a check.  Only the default go-couchbase store queries a
+// view, and only when not using N1QL.
+type ViewMetricsRecorder interface {
+
+	// Called after every view query, with the design doc and view queried,
+	// how long just the query took, and the error if it failed
+	ViewQueried(designDocName, viewName string, duration time.Duration, err error)
+}
+
+// The default MetricsRecorder, which does nothing
+type noopMetrics struct{}
+
+func (noopMetrics) HeartbeatSent(err error)                                         {}
+func (noopMetrics) StaleNodeDetected(nodeUuid string)                               {}
+func (noopMetrics) CheckCompleted(duration time.Duration, liveNodes int, err error) {}
@@ -0,0 +1,274 @@
+package cbheartbeat
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// A Store which keeps a copy of every doc in each of several Stores, eg
+// buckets on separate clusters, so that losing one of them doesn't blind
+// the checker or stop the sender.
+//
+// The quorum is the number of stores that must agree:
+//
+//   - A write succeeds once at least quorum stores have accepted it.  Writes
+//     which fail on the other stores are not retried, the next heartbeat
+//     will overwrite them anyway.
+//   - Insert and Renew also need a strict majority of the stores to write
+//     the doc, see multiStore.Insert.
+//   - A doc exists if at least quorum stores have it.  Stores which return
+//     an error are left out, as long as at least quorum stores answered,
+//     otherwise there's no way to tell and the error is returned.
+//   - QueryHeartbeatDocs returns the docs found in any store which answered,
+//     one per node, again as long as at least quorum stores answered.
+//
+// So with a quorum of 1 a node is alive as long as its heartbeat reached any
+// store, and with a quorum of len(stores) it's alive only if it reached
+// every one of them.
+type multiStore struct {
+	stores []Store
+	quorum int
+}
+
+// Create a Store which writes to and reads from each of the given stores,
+// see multiStore for what quorum means.  Pass it to NewHeartbeaterWithStore,
+// eg with a Store from NewCouchbaseStore for each bucket.
+func NewMultiStore(quorum int, stores ...Store) (Store, error) {
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("Invalid stores: need at least one")
+	}
+	if quorum < 1 || quorum > len(stores) {
+		return nil, fmt.Errorf("Invalid quorum %v: must be between 1 and %v", quorum, len(stores))
+	}
+	return &multiStore{stores: stores, quorum: quorum}, nil
+}
+
+// Return nil if at least quorum of the results were successful, otherwise
+// the first error
+func (m *multiStore) quorumErr(errs []error) error {
+
+	succeeded := 0
+	var firstErr error
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if succeeded >= m.quorum {
+		return nil
+	}
+	return fmt.Errorf("Only %v of %v stores succeeded, need %v: %v", succeeded, len(m.stores), m.quorum, firstErr)
+
+}
+
+func (m *multiStore) Upsert(docId string, doc interface{}, ttl time.Duration) error {
+	errs := make([]error, len(m.stores))
+	for i, store := range m.stores {
+		errs[i] = store.Upsert(docId, doc, ttl)
+	}
+	return m.quorumErr(errs)
+}
+
+func (m *multiStore) UpsertDurable(docId string, doc interface{}, ttl time.Duration, durability Durability) error {
+	errs := make([]error, len(m.stores))
+	for i, store := range m.stores {
+		durableStore, ok := store.(DurableStore)
+		if !ok {
+			errs[i] = fmt.Errorf("Store %T doesn't support durable writes", store)
+			continue
+		}
+		errs[i] = durableStore.UpsertDurable(docId, doc, ttl, durability)
+	}
+	return m.quorumErr(errs)
+}
+
+// Returns ErrDocNotFound if any store doesn't have the doc, rather than
+// only if quorum stores don't, so that the caller rewrites it everywhere
+func (m *multiStore) Touch(docId string, ttl time.Duration) error {
+	errs := make([]error, len(m.stores))
+	for i, store := range m.stores {
+		touchStore, ok := store.(TouchStore)
+		if !ok {
+			errs[i] = fmt.Errorf("Store %T doesn't support touch", store)
+			continue
+		}
+		errs[i] = touchStore.Touch(docId, ttl)
+		if errs[i] == ErrDocNotFound {
+			return ErrDocNotFound
+		}
+	}
+	return m.quorumErr(errs)
+}
+
+// The doc counts as written if it was added to at least quorum stores, and
+// to a strict majority of them whatever the quorum, since leader election
+// and WithSingleNotifier rely on only one caller winning an Insert.  Two
+// callers racing with a lower quorum could otherwise each win in different
+// stores.  When neither gets a majority, both lose until the docs they did
+// add expire.
+func (m *multiStore) Insert(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+
+	errs := make([]error, len(m.stores))
+	added := 0
+	for i, store := range m.stores {
+		ok, err := store.Insert(docId, doc, ttl)
+		if ok {
+			added++
+		}
+		errs[i] = err
+	}
+	if err := m.quorumErr(errs); err != nil {
+		return false, err
+	}
+	return added >= m.quorum && added*2 > len(m.stores), nil
+
+}
+
+// Like Insert, the doc counts as renewed only if it was renewed in at least
+// quorum stores and a strict majority of them.  ErrDocNotFound is only
+// returned if no store which answered had the doc.
+func (m *multiStore) Renew(docId string, doc interface{}, ttl time.Duration) (bool, error) {
+
+	errs := make([]error, len(m.stores))
+	renewed, found := 0, 0
+	for i, store := range m.stores {
+		casStore, ok := store.(CasStore)
+		if !ok {
+			errs[i] = fmt.Errorf("Store %T doesn't support compare-and-swap", store)
+			continue
+		}
+		ok, err := casStore.Renew(docId, doc, ttl)
+		switch {
+		case err == ErrDocNotFound:
+		case err != nil:
+			errs[i] = err
+		case ok:
+			renewed++
+			found++
+		default:
+			found++
+		}
+	}
+	if err := m.quorumErr(errs); err != nil {
+		return false, err
+	}
+	if found == 0 {
+		return false, ErrDocNotFound
+	}
+	return renewed >= m.quorum && renewed*2 > len(m.stores), nil
+
+}
+
+func (m *multiStore) Get(docId string, doc interface{}) error {
+
+	found, answered := 0, 0
+	var firstErr error
+	for _, store := range m.stores {
+		var err error
+		if found == 0 {
+			err = store.Get(docId, doc)
+		} else {
+			// already have a copy, only need to know whether it's here
+			var raw json.RawMessage
+			err = store.Get(docId, &raw)
+		}
+		switch {
+		case err == nil:
+			found++
+			answered++
+		case err == ErrDocNotFound:
+			answered++
+		case firstErr == nil:
+			firstErr = err
+		}
+	}
+	if answered < m.quorum {
+		return fmt.Errorf("Only %v of %v stores answered, need %v: %v", answered, len(m.stores), m.quorum, firstErr)
+	}
+	if found < m.quorum {
+		return ErrDocNotFound
+	}
+	return nil
+
+}
+
+// Deleting a doc which a store doesn't have counts as success for that
+// store.  ErrDocNotFound is only returned if no store had the doc.
+func (m *multiStore) Delete(docId string) error {
+
+	errs := make([]error, len(m.stores))
+	deleted := false
+	for i, store := range m.stores {
+		err := store.Delete(docId)
+		switch err {
+		case nil:
+			deleted = true
+		case ErrDocNotFound:
+			err = nil
+		}
+		errs[i] = err
+	}
+	if err := m.quorumErr(errs); err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrDocNotFound
+	}
+	return nil
+
+}
+
+func (m *multiStore) PrepareHeartbeatQuery(heartbeatDocType string) error {
+	errs := make([]error, len(m.stores))
+	for i, store := range m.stores {
+		errs[i] = store.PrepareHeartbeatQuery(heartbeatDocType)
+	}
+	return m.quorumErr(errs)
+}
+
+// Each node's heartbeat doc is usually in every store, so only the most
+// recent copy of it is returned
+func (m *multiStore) QueryHeartbeatDocs(heartbeatDocType, docIdPrefix string) ([]json.RawMessage, error) {
+
+	errs := make([]error, len(m.stores))
+	newest := map[string]json.RawMessage{}
+	lastSeen := map[string]int64{}
+	docs := []json.RawMessage{}
+	for i, store := range m.stores {
+		storeDocs, err := store.QueryHeartbeatDocs(heartbeatDocType, docIdPrefix)
+		errs[i] = err
+		for _, doc := range storeDocs {
+			meta := heartbeatMeta{}
+			if err := json.Unmarshal(doc, &meta); err != nil || meta.NodeUUID == "" {
+				// leave it to the checker to report
+				docs = append(docs, doc)
+				continue
+			}
+			if _, ok := newest[meta.NodeUUID]; !ok || meta.Timestamp > lastSeen[meta.NodeUUID] {
+				newest[meta.NodeUUID] = doc
+				lastSeen[meta.NodeUUID] = meta.Timestamp
+			}
+		}
+	}
+	if err := m.quorumErr(errs); err != nil {
+		return nil, err
+	}
+	for _, doc := range newest {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+
+}
+
+func (m *multiStore) Close() error {
+	var firstErr error
+	for _, store := range m.stores {
+		if err := store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
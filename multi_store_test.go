@@ -0,0 +1,152 @@
+package cbheartbeat_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tleyden/cb-heartbeat"
+	"github.com/tleyden/cb-heartbeat/cbheartbeattest"
+)
+
+// A multiStore over n MemoryStores sharing the cluster's clock, and the
+// stores themselves
+func newMultiStore(t *testing.T, c *cluster, quorum, n int) (cbheartbeat.Store, []*cbheartbeattest.MemoryStore) {
+	t.Helper()
+	stores := []*cbheartbeattest.MemoryStore{}
+	multiStores := []cbheartbeat.Store{}
+	for i := 0; i < n; i++ {
+		store := cbheartbeattest.NewMemoryStore(c.clock)
+		stores = append(stores, store)
+		multiStores = append(multiStores, store)
+	}
+	multiStore, err := cbheartbeat.NewMultiStore(quorum, multiStores...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return multiStore, stores
+}
+
+// Make every operation on the store fail, as if its cluster were down
+func takeDown(store *cbheartbeattest.MemoryStore) {
+	store.SetFailure(func(op, docId string) error {
+		return errors.New("cluster down")
+	})
+}
+
+func TestInvalidQuorum(t *testing.T) {
+	store := cbheartbeattest.NewMemoryStore(newCluster(t).clock)
+	for _, quorum := range []int{0, 3} {
+		if _, err := cbheartbeat.NewMultiStore(quorum, store, store); err == nil {
+			t.Errorf("quorum %v of 2 stores was accepted", quorum)
+		}
+	}
+	if _, err := cbheartbeat.NewMultiStore(1); err == nil {
+		t.Error("no stores was accepted")
+	}
+}
+
+func TestMultiStoreQuorum(t *testing.T) {
+
+	c := newCluster(t)
+	multiStore, stores := newMultiStore(t, c, 2, 3)
+
+	// one store down is fine with a quorum of 2
+	takeDown(stores[2])
+	if err := multiStore.Upsert("a", "doc", time.Minute); err != nil {
+		t.Fatalf("Upsert with 2 of 3 stores up: %v", err)
+	}
+	var doc string
+	if err := multiStore.Get("a", &doc); err != nil || doc != "doc" {
+		t.Fatalf("Get with 2 of 3 stores up gave %q, %v", doc, err)
+	}
+
+	// but not two
+	takeDown(stores[1])
+	if err := multiStore.Upsert("a", "doc", time.Minute); err == nil {
+		t.Fatal("Upsert succeeded with 1 of 3 stores up")
+	}
+	if err := multiStore.Get("a", &doc); err == nil || err == cbheartbeat.ErrDocNotFound {
+		t.Fatalf("Get with 1 of 3 stores up gave %v, want an error saying there's no way to tell", err)
+	}
+
+	// a doc in fewer than quorum stores doesn't count
+	stores[1].SetFailure(nil)
+	stores[2].SetFailure(nil)
+	if err := stores[0].Upsert("b", "doc", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := multiStore.Get("b", &doc); err != cbheartbeat.ErrDocNotFound {
+		t.Fatalf("Get of a doc in 1 of 3 stores gave %v, want ErrDocNotFound", err)
+	}
+
+}
+
+// Only one of two callers racing to insert the same doc can win, even when
+// each got to a different store first
+func TestMultiStoreInsertNeedsMajority(t *testing.T) {
+
+	c := newCluster(t)
+	multiStore, stores := newMultiStore(t, c, 1, 2)
+	if _, err := stores[1].Insert("leader", "b", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	added, err := multiStore.Insert("leader", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added {
+		t.Fatal("Insert won with 1 of 2 stores")
+	}
+
+}
+
+// Each node's newest heartbeat doc is returned once, wherever it came from
+func TestMultiStoreQueryHeartbeatDocs(t *testing.T) {
+
+	c := newCluster(t)
+	multiStore, stores := newMultiStore(t, c, 1, 2)
+	h := c.heartbeaterWithStore(multiStore, "a")
+	sendOnce(t, h, time.Second)
+
+	// the second store misses a's next heartbeat
+	takeDown(stores[1])
+	c.clock.Advance(time.Second)
+	sendOnce(t, h, time.Second)
+	stores[1].SetFailure(nil)
+
+	docs, err := multiStore.QueryHeartbeatDocs(cbheartbeat.DocKindHeartbeat, cbheartbeat.DocKindHeartbeat+":")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSeen := []time.Time{}
+	for _, doc := range docs {
+		heartbeatDoc := struct {
+			LastSeen int64 `json:"last_seen"`
+		}{}
+		if err := json.Unmarshal(doc, &heartbeatDoc); err != nil {
+			t.Fatal(err)
+		}
+		lastSeen = append(lastSeen, time.Unix(0, heartbeatDoc.LastSeen*int64(time.Millisecond)).UTC())
+	}
+	if want := []time.Time{c.clock.Now()}; !reflect.DeepEqual(lastSeen, want) {
+		t.Fatalf("got heartbeats last seen at %v, want %v", lastSeen, want)
+	}
+
+}
+
+// With a quorum of 1, a node is alive as long as its heartbeat reached any
+// store
+func TestMultiStoreClusterDown(t *testing.T) {
+
+	c := newCluster(t)
+	multiStore, stores := newMultiStore(t, c, 1, 2)
+	takeDown(stores[0])
+	sendOnce(t, c.heartbeaterWithStore(multiStore, "a"), time.Minute)
+	if liveNodes, err := c.heartbeaterWithStore(multiStore, "b").LiveNodes(); err != nil || !reflect.DeepEqual(liveNodes, []string{"a"}) {
+		t.Fatalf("LiveNodes = %v, %v with one store down, want [a]", liveNodes, err)
+	}
+
+}
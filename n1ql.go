@@ -0,0 +1,133 @@
+package cbheartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The response body from the N1QL query service REST API
+type n1qlResponse struct {
+	Status  string          `json:"status"`
+	Results json.RawMessage `json:"results"`
+	Errors  []struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	} `json:"errors"`
+}
+
+// Query the heartbeat docs with N1QL instead of the map-reduce view
+func (s *couchbaseStore) n1qlQueryHeartbeatDocs(heartbeatDocType, docIdPrefix string) ([]json.RawMessage, error) {
+
+	statement := fmt.Sprintf(
+		"SELECT b.* FROM %v AS b WHERE b.type = %v AND META(b).id >= %v AND META(b).id < %v",
+		n1qlIdentifier(s.bucketName),
+		n1qlString(heartbeatDocType),
+		n1qlString(docIdPrefix),
+		n1qlString(docIdPrefix+docIdRangeEnd),
+	)
+
+	heartbeats := []json.RawMessage{}
+	if err := s.n1qlQuery(statement, &heartbeats); err != nil {
+		return nil, err
+	}
+	return heartbeats, nil
+
+}
+
+// Create the index needed by n1qlQueryHeartbeatDocs, if it doesn't already exist
+func (s *couchbaseStore) addHeartbeatCheckIndex(heartbeatDocType string) error {
+
+	// eg "heartbeats" for the default doc type
+	statement := fmt.Sprintf(
+		"CREATE INDEX %v ON %v(type) WHERE type = %v",
+		n1qlIdentifier(s.keyPrefix+heartbeatDocType+"s"),
+		n1qlIdentifier(s.bucketName),
+		n1qlString(heartbeatDocType),
+	)
+
+	err := s.n1qlQuery(statement, nil)
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		return nil
+	}
+	return err
+
+}
+
+// Quote a string for use as a N1QL string literal.  N1QL accepts JSON
+// strings, so this is safe whatever the string contains.
+func n1qlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// Quote a name, eg of a bucket or index, for use as a N1QL identifier.  A
+// backtick within the name is escaped by doubling it.
+func n1qlIdentifier(s string) string {
+	return "`" + strings.Replace(s, "`", "``", -1) + "`"
+}
+
+// Run a N1QL statement against the query service, and unmarshal the results
+// into result unless it is nil.  Uses request_plus consistency, which is
+// the N1QL equivalent of stale=false.
+func (s *couchbaseStore) n1qlQuery(statement string, result interface{}) error {
+
+	form := url.Values{}
+	form.Set("statement", statement)
+	form.Set("scan_consistency", "request_plus")
+
+	req, err := http.NewRequest("POST", s.getN1QLQueryUrl(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	if s.operationTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.operationTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if username, password := s.n1qlCredentials(); username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("N1QL query: %w after %v", ErrOperationTimeout, s.operationTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	n1qlResp := n1qlResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&n1qlResp); err != nil {
+		return err
+	}
+	if len(n1qlResp.Errors) > 0 {
+		return fmt.Errorf("N1QL query failed: %v (code %v)", n1qlResp.Errors[0].Msg, n1qlResp.Errors[0].Code)
+	}
+	if n1qlResp.Status != "success" {
+		return fmt.Errorf("N1QL query failed with status: %v", n1qlResp.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(n1qlResp.Results, result)
+
+}
+
+// The credentials for the query service: the same ones the bucket was opened
+// with, from the AuthHandler if there is one.  Empty if there are none, eg
+// when they are embedded in the query url.
+func (s *couchbaseStore) n1qlCredentials() (string, string) {
+	if s.authHandler != nil {
+		username, password, _ := s.authHandler.GetCredentials()
+		return username, password
+	}
+	return s.username, s.password
+}
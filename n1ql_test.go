@@ -0,0 +1,112 @@
+package cbheartbeat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A query service which answers every statement with the given response,
+// and the requests it has received
+func newN1QLServer(t *testing.T, response string) (*httptest.Server, <-chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests <- r
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+type testAuthHandler struct{}
+
+func (testAuthHandler) GetCredentials() (string, string, string) {
+	return "handler-user", "handler-password", "default"
+}
+
+// The query service is authenticated to with the same credentials as the
+// bucket
+func TestN1QLCredentials(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		opts         []Option
+		wantUsername string
+		wantPassword string
+	}{
+		{"none", nil, "", ""},
+		{"credentials", []Option{WithCredentials("user", "password")}, "user", "password"},
+		{"auth handler", []Option{WithCredentials("user", "password"), WithAuthHandler(testAuthHandler{})}, "handler-user", "handler-password"},
+	} {
+		server, requests := newN1QLServer(t, `{"status": "success", "results": []}`)
+		store := newTestCouchbaseStore(t, append(test.opts, WithN1QL(server.URL))...)
+		if err := store.n1qlQuery("SELECT 1", nil); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		username, password, _ := (<-requests).BasicAuth()
+		if username != test.wantUsername || password != test.wantPassword {
+			t.Errorf("%v: authenticated as %q/%q, want %q/%q", test.name, username, password, test.wantUsername, test.wantPassword)
+		}
+	}
+}
+
+func TestN1QLQueryHeartbeatDocs(t *testing.T) {
+
+	server, requests := newN1QLServer(t, `{"status": "success", "results": [{"type": "heartbeat", "node_uuid": "a"}]}`)
+	store := newTestCouchbaseStore(t, WithN1QL(server.URL))
+	docs, err := store.QueryHeartbeatDocs("heartbeat", "heartbeat:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || string(docs[0]) != `{"type": "heartbeat", "node_uuid": "a"}` {
+		t.Fatalf("got docs %s, want a's heartbeat doc", docs)
+	}
+
+	req := <-requests
+	want := "SELECT b.* FROM `default` AS b WHERE b.type = \"heartbeat\" AND META(b).id >= \"heartbeat:\" AND META(b).id < \"heartbeat:\U0010ffff\""
+	if statement := req.PostForm.Get("statement"); statement != want {
+		t.Errorf("statement %v, want %v", statement, want)
+	}
+	if consistency := req.PostForm.Get("scan_consistency"); consistency != "request_plus" {
+		t.Errorf("scan consistency %q, want request_plus", consistency)
+	}
+
+}
+
+func TestN1QLErrors(t *testing.T) {
+	server, _ := newN1QLServer(t, `{"status": "errors", "errors": [{"code": 4000, "msg": "No index available"}]}`)
+	store := newTestCouchbaseStore(t, WithN1QL(server.URL))
+	if _, err := store.QueryHeartbeatDocs("heartbeat", "heartbeat:"); err == nil || !strings.Contains(err.Error(), "No index available") {
+		t.Fatalf("got error %v, want the query service's", err)
+	}
+}
+
+// An existing index is fine, but if the index can't be created at all the
+// store goes back to using the view
+func TestN1QLIndex(t *testing.T) {
+
+	server, requests := newN1QLServer(t, `{"status": "errors", "errors": [{"code": 4300, "msg": "The index heartbeats already exists."}]}`)
+	store := newTestCouchbaseStore(t, WithN1QL(server.URL))
+	if err := store.PrepareHeartbeatQuery("heartbeat"); err != nil {
+		t.Fatal(err)
+	}
+	want := "CREATE INDEX `heartbeats` ON `default`(type) WHERE type = \"heartbeat\""
+	if statement := (<-requests).PostForm.Get("statement"); statement != want {
+		t.Errorf("statement %v, want %v", statement, want)
+	}
+	if store.getN1QLQueryUrl() == "" {
+		t.Error("fell back to the view even though the index exists")
+	}
+
+	server, _ = newN1QLServer(t, `{"status": "errors", "errors": [{"code": 12003, "msg": "Keyspace not found"}]}`)
+	store = newTestCouchbaseStore(t, WithN1QL(server.URL), WithSkipViewCreation(true))
+	if err := store.PrepareHeartbeatQuery("heartbeat"); err != nil {
+		t.Fatal(err)
+	}
+	if store.getN1QLQueryUrl() != "" {
+		t.Error("didn't fall back to the view when the index couldn't be created")
+	}
+
+}
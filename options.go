@@ -0,0 +1,511 @@
+package cbheartbeat
+
+import (
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+)
+
+// An Option configures a heartbeater created by NewCouchbaseHeartbeaterWithOptions
+type Option func(h *couchbaseHeartBeater)
+
+// The prefix which will be prepended to the heartbeat doc keys
+func WithKeyPrefix(keyPrefix string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.keyPrefix = keyPrefix
+	}
+}
+
+// The opaque identifier for the node where this is running.  See
+// NewCouchbaseHeartbeater for details.
+func WithNodeUUID(nodeUuid string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.nodeUuid = nodeUuid
+	}
+}
+
+// The Logger used to report errors from the sender and checker goroutines.
+// Defaults to the standard library logger.
+func WithLogger(logger Logger) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.logger = logger
+	}
+}
+
+// Prepend this to the "type" field of every doc that is written, eg
+// "myapp_heartbeat" rather than "heartbeat", so that the heartbeat view or
+// N1QL query doesn't pick up docs from anything else in the same bucket that
+// uses the same convention.  All nodes must use the same prefix.
+func WithDocTypePrefix(prefix string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.heartbeatDocType = prefix + docTypeHeartbeat
+		h.timeoutDocType = prefix + docTypeHeartbeatTimeout
+		h.staleDocType = prefix + docTypeHeartbeatStale
+		h.leaderDocType = prefix + docTypeHeartbeatLeader
+	}
+}
+
+// The name of the design doc that holds the heartbeat view, so that several
+// independent users of this library can share a bucket without their views
+// colliding.  Defaults to "cbgt".
+func WithDesignDoc(designDocName string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.designDocName = designDocName
+	}
+}
+
+// The name of the heartbeat view within the design doc.  Defaults to "heartbeats".
+func WithViewName(viewName string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.viewName = viewName
+	}
+}
+
+// Don't create or update the heartbeat design doc when the checker starts,
+// and assume an admin has already created it, for when the bucket user isn't
+// allowed to manage design docs.  The view must be named as set with
+// WithDesignDoc and WithViewName, and have the map function
+//
+//	function (doc, meta) { if (doc.type == "heartbeat") { emit(meta.id, doc); }}
+//
+// with the type changed to match WithDocTypePrefix if used.  If the view is
+// missing, every check fails with an error saying so.
+func WithSkipViewCreation(skip bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.skipViewCreation = skip
+	}
+}
+
+// The buffer size of the channel returned by StaleEvents.  Defaults to 100.
+func WithStaleEventsBufferSize(size int) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.staleEventsBufferSize = size
+	}
+}
+
+// The buffer size of the channel returned by Errors.  Defaults to 100.
+func WithErrorsBufferSize(size int) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.errorsBufferSize = size
+	}
+}
+
+// The heartbeat timeout doc expires after the send interval multiplied by this
+// value, after which other nodes consider this node stale.  Defaults to 2.
+func WithTimeoutMultiplier(multiplier float64) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.timeoutMultiplier = multiplier
+	}
+}
+
+// Extra time added to the heartbeat timeout doc expiry, on top of the
+// multiplied send interval.  Defaults to 0.  Since checkers only look at
+// whether the timeout doc has expired, this and WithTimeoutMultiplier are
+// per node: eg nodes on flaky links can give themselves a longer grace
+// period than the rest of the cluster, and every checker will respect it.
+// The resulting expiry is advertised in the heartbeat doc, see
+// NodeInfo.Timeout.
+func WithTimeoutGracePeriod(gracePeriod time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.timeoutGracePeriod = gracePeriod
+	}
+}
+
+// How long this node's heartbeat doc lives after its last heartbeat, so that
+// it cleans itself up even if no checker ever reports the node as stale.
+// This must comfortably exceed the time it takes checkers to notice the
+// heartbeat timeout doc has expired, or a dead node could disappear without
+// being reported, so it is raised to at least 10 times the timeout doc's
+// expiry.  Defaults to 24 hours.  Pass 0 for heartbeat docs that never
+// expire, as in earlier versions.
+func WithHeartbeatDocTTL(ttl time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.heartbeatDocTTL = ttl
+	}
+}
+
+// Authenticate to Couchbase Server with the given username and password,
+// rather than credentials embedded in the url.  Needed for RBAC-enabled
+// clusters where each bucket has its own users.
+func WithCredentials(username, password string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.username = username
+		h.couchbase.password = password
+	}
+}
+
+// Call back the handler once this many heartbeats in a row have failed to be
+// written, and again once one succeeds.  Retries within a single heartbeat,
+// see WithSendRetries, don't count as separate failures.
+func WithSelfUnhealthyHandler(failures int, handler SelfUnhealthyHandler) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.selfUnhealthyAfter = failures
+		h.selfUnhealthyHandler = handler
+	}
+}
+
+// Give up waiting for a single Couchbase Server operation, eg writing a
+// heartbeat doc or querying the view, after this long, so that a hung
+// connection can't stall the sender or checker.  The operation fails with
+// ErrOperationTimeout and is tried again at the next interval.  Defaults to
+// 30 seconds, 0 for no limit.
+func WithOperationTimeout(timeout time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.operationTimeout = timeout
+	}
+}
+
+// Authenticate to Couchbase Server with the given go-couchbase AuthHandler,
+// eg one the app already uses for its own connections, rather than
+// credentials embedded in the url.  Takes precedence over WithCredentials.
+func WithAuthHandler(authHandler couchbase.AuthHandler) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.authHandler = authHandler
+	}
+}
+
+// Retry connecting to the bucket when creating the heartbeater, rather than
+// failing straight away, so that services can start before Couchbase Server
+// is ready, eg in Kubernetes.  Retries up to maxRetries times, waiting
+// baseDelay before the first retry and doubling it after each one, and gives
+// up early rather than wait past timeout (0 for no limit).  The last error
+// is returned if it gives up.  Defaults to no retries.
+func WithConnectRetry(maxRetries int, baseDelay, timeout time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.connectRetries = maxRetries
+		h.couchbase.connectRetryDelay = baseDelay
+		h.couchbase.connectTimeout = timeout
+	}
+}
+
+// The Couchbase Server pool that contains the bucket.  Defaults to "default".
+func WithPoolName(poolName string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.poolName = poolName
+	}
+}
+
+// How many times to retry writing a heartbeat doc when it fails with a
+// transient error, and how long to wait before the first retry.  The delay
+// doubles after each retry.  Defaults to 2 retries, starting at 100ms.
+func WithSendRetries(retries int, baseDelay time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.sendRetries = retries
+		h.sendRetryDelay = baseDelay
+	}
+}
+
+// The minimum time between attempts to reconnect to the bucket after the
+// connection has been lost.  Defaults to 5 seconds.
+func WithReconnectInterval(interval time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.reconnectInterval = interval
+	}
+}
+
+// Randomize each wait between heartbeats by up to +/- this fraction of the
+// send interval (eg 0.1 for 10%), to avoid many nodes writing at the same
+// instant.  Must be at least 0 and less than 1.  Defaults to 0, meaning no
+// jitter.
+func WithJitter(fraction float64) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.jitter = fraction
+	}
+}
+
+// Metadata to store in this node's heartbeat doc, see SetMetadata
+func WithMetadata(metadata map[string]string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.metadata = copyMetadata(metadata)
+	}
+}
+
+// Report heartbeat activity to the given MetricsRecorder
+func WithMetrics(metrics MetricsRecorder) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.metrics = metrics
+	}
+}
+
+// Start spans with the given Tracer around sending heartbeats, checking
+// heartbeats and each Store operation.  See the cbotel subpackage for
+// OpenTelemetry.  Defaults to a Tracer that does nothing.
+func WithTracer(tracer Tracer) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.tracer = tracer
+	}
+}
+
+// Use the given Clock rather than the real one, eg a
+// cbheartbeattest.FakeClock in tests
+func WithClock(clock Clock) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.clock = clock
+	}
+}
+
+// Find heartbeat docs with N1QL queries against the query service at the
+// given url (eg http://localhost:8093/query/service), rather than with a
+// map-reduce view.  If the query service can't be reached when the checker
+// starts, it falls back to using the view.  The queries are authenticated
+// with the credentials from WithAuthHandler or WithCredentials.
+func WithN1QL(queryUrl string) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.n1qlQueryUrl = queryUrl
+	}
+}
+
+// How up to date the heartbeat view index must be when the checker queries
+// it.  Defaults to StaleFalse.
+func WithViewStaleness(staleness ViewStaleness) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.couchbase.viewStaleness = staleness
+	}
+}
+
+// Only declare a node stale after its heartbeat timeout doc has been missing
+// for this many consecutive checks, to avoid false positives on flaky
+// networks.  Defaults to 1.
+func WithStaleAfterMissedChecks(missedChecks int) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.staleAfterMissedChecks = missedChecks
+	}
+}
+
+// Decide each node's stale threshold with the given function, rather than
+// using the threshold passed to StartCheckingHeartbeatsContext for every
+// node, eg to give a node that has been flapping a shorter leash and a
+// reliable node more slack.  The checker still runs at the interval given
+// by the threshold passed to Start, or WithCheckInterval, so thresholds
+// shorter than that interval take effect at the next check.
+func WithStaleThresholdFunc(staleThreshold StaleThresholdFunc) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.staleThresholdFunc = staleThreshold
+	}
+}
+
+// Only rewrite the heartbeat doc when its contents change, eg after
+// SetMetadata, and otherwise just reset the expiry of both docs, which is
+// much cheaper than writing them in big clusters with short send intervals.
+// Either doc is rewritten if it turns out to be missing.  The
+// heartbeat doc's last-seen time and sequence then no longer advance with
+// every heartbeat, so other nodes skip clock skew, sequence and phi accrual
+// checks for this node.  Needs a Store which implements TouchStore, and is
+// ignored when using WithDurability.
+func WithMinimalWrites(minimal bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.minimalWrites = minimal
+	}
+}
+
+// Write a single doc per node, which expires after the heartbeat timeout,
+// rather than a heartbeat doc plus a separate heartbeat timeout doc.  This
+// halves the number of docs and saves checkers a lookup per node, but a
+// checker can only report a node stale if it has seen its heartbeat doc
+// before it expired, so a node which dies while no checker is running goes
+// unreported, and a node which calls Deregister is reported stale.  Every
+// node sharing the bucket and key prefix must use the same mode.  Implies
+// WithMinimalWrites(false).
+func WithSingleDoc(single bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.singleDoc = single
+	}
+}
+
+// Name docs with the given function rather than "<keyPrefix><kind>:<nodeUuid>",
+// eg to follow a bucket's key naming scheme.  The key prefix isn't added, so
+// include it in the function if needed.  Heartbeat docs are then found by
+// their type alone rather than also by their id, so use WithDocTypePrefix to
+// keep them apart from other users of the library in the same bucket.  Every
+// node sharing the bucket must use the same function.
+func WithDocIdFunc(docIdFunc DocIdFunc) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.docIdFunc = docIdFunc
+	}
+}
+
+// Write heartbeat and timeout docs with the given codec rather than the
+// default JSON, eg to match an existing document schema.  Every node sharing
+// the bucket and key prefix must use the same codec.  NewMultiStore can't
+// tell which copy of a heartbeat doc is newest unless the encoded doc keeps
+// the default "node_uuid" and "last_seen" fields.
+func WithDocCodec(codec DocCodec) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.docCodec = codec
+	}
+}
+
+// Also report a node as stale once the phi accrual failure detector's
+// suspicion level for it reaches threshold, even if its heartbeat timeout
+// doc hasn't expired yet.  The detector learns each node's usual interval
+// between heartbeats, and how much it varies, from the timestamps in its
+// heartbeat docs, so a threshold of around 8 adapts to each node without
+// tuning the TTL.  Since the timestamps come from the other nodes' clocks,
+// the clocks need to be in sync to well within the send interval.  See Phi.
+func WithPhiAccrual(threshold float64) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.phiThreshold = threshold
+	}
+}
+
+// Keep the heartbeat docs of nodes that are detected as stale, rather than
+// deleting them.  Repeated notifications are then suppressed by remembering
+// which nodes have already been reported, instead of by the doc being gone.
+// This also avoids one checker's delete racing with another checker.
+func WithKeepStaleDocs(keep bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.keepStaleDocs = keep
+	}
+}
+
+// Never write to the store from the checker, eg for an audit or monitoring
+// node that should observe the cluster without side effects.  Heartbeat docs
+// of stale nodes are kept, as with WithKeepStaleDocs, and WithSingleNotifier
+// is ignored since it needs a marker doc, so every read-only checker
+// notifies about every stale node.  Cleaning up is left to the other nodes'
+// checkers, or to ReapStaleDocs.  The view or index isn't created either,
+// so another node must have started its checker first.
+func WithReadOnlyChecker(readOnly bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.readOnlyChecker = readOnly
+	}
+}
+
+// Make sure only one checker in the whole cluster notifies about each stale
+// node, rather than every node that runs a checker.  The first checker to
+// atomically create a marker doc for the stale node wins, and the others
+// stay quiet.
+func WithSingleNotifier(single bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.singleNotifier = single
+	}
+}
+
+// Claim each stale node with a marker doc that lives for ttl, as with
+// WithSingleNotifier, so that the node isn't reported again while the marker
+// exists, even by a checker which restarted and so forgot which nodes it had
+// already reported, eg with WithKeepStaleDocs.  Once the marker expires, the
+// node can be reported again.  The marker is deleted as soon as a checker
+// sees the node rejoin.  Without this, the marker only lives for a few stale
+// thresholds.
+func WithStaleMarkerTTL(ttl time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.staleMarkerTTL = ttl
+	}
+}
+
+// Never report nodes as stale if the given function returns true for them,
+// eg to skip cold standbys by naming convention.  Called from the checker
+// goroutine for each node whose heartbeat timeout doc is missing, so it
+// must be safe to call concurrently with whatever changes its answer.  See
+// also SetExcludedNodes.
+func WithExcludeNodeFunc(exclude func(nodeUuid string) bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.excludeNodeFunc = exclude
+	}
+}
+
+// Handle the nodes found stale by a check, ie call back the handlers and
+// delete their heartbeat docs, on this many goroutines rather than one at a
+// time, so that a check doesn't take too long when many nodes go stale at
+// once, eg in a big cluster after a network partition.  With more than one
+// worker, synchronous handlers may be called concurrently and in any order.
+// Defaults to 1.
+func WithCheckWorkers(workers int) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.checkWorkers = workers
+	}
+}
+
+// Check for stale heartbeats this often, rather than once every stale
+// threshold, so that a node is noticed soon after its heartbeat timeout doc
+// expires, rather than up to a whole threshold later.  Nodes which
+// advertise their own timeout in their heartbeat doc, as every node running
+// this version does, are then reported as soon as a check finds the doc
+// expired, and older nodes once it has been missing for the stale threshold,
+// eg check every 5 seconds but only declare them stale after 60.  Ignored
+// if it isn't shorter than the stale threshold.  Defaults to 0, meaning
+// check once every stale threshold.
+func WithCheckInterval(interval time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.checkInterval = interval
+	}
+}
+
+// Run as an observer, which checks other nodes for stale heartbeats but is
+// not itself a member of the cluster, eg for a dashboard or an external
+// monitor.  StartSendingHeartbeats returns ErrObserver rather than writing
+// anything, and no nodeUuid is needed.  Defaults to false.
+func WithObserver(observer bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.observer = observer
+	}
+}
+
+// Deregister this node when Close is called, so that other nodes see it as
+// gone straight away.  Defaults to false.
+func WithDeregisterOnClose(deregister bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.deregisterOnClose = deregister
+	}
+}
+
+// Call each handler on its own goroutine, so that a slow handler (eg one
+// that makes an HTTP call) can't stall the checker and delay the detection of
+// other stale nodes.  Handler calls then run concurrently with each other
+// and with later checks, in no particular order, so a NodeRejoined call can
+// even overtake the stale notification for the same node.  The checker still
+// deletes stale heartbeat docs straight away.  Defaults to false, meaning
+// handlers are called synchronously, in order, on the checker goroutine.
+func WithAsyncHandlers(async bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.asyncHandlers = async
+	}
+}
+
+// Notify handlers about at most maxNodes stale nodes per check, so that a
+// network partition which makes dozens of nodes go stale at once doesn't set
+// off a storm of pages or reconfigurations.  The nodes over the limit are
+// passed in one call to each handler which implements CoalescedStaleHandler,
+// and queued for the other handlers, which are then notified about them at
+// the start of later checks, oldest first and still at most maxNodes per
+// check.  A queued node which rejoins in the meantime is dropped from the
+// queue.  Stale heartbeat docs are still deleted, and StaleEvents still
+// receives every node, straight away.  0, the default, means no limit.
+func WithStaleHandlerLimit(maxNodes int) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.staleHandlerLimit = maxNodes
+	}
+}
+
+// Treat a node as having missed a check when the sequence number in its
+// heartbeat doc hasn't changed since the previous check, even if its
+// heartbeat timeout doc hasn't expired yet.  This catches a node that has
+// frozen sooner than waiting for the expiry, but the stale threshold must
+// then be longer than the send interval of every node.  Defaults to false.
+func WithSequenceChecking(check bool) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.checkSequences = check
+	}
+}
+
+// Log a warning when the checker sees a node whose clock appears to be off
+// from ours by more than this, see ClockSkew.  Since heartbeat docs can be up
+// to a send interval old, this should be comfortably more than the send
+// interval.  Defaults to 0, meaning no warning.
+func WithClockSkewWarning(threshold time.Duration) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.clockSkewWarning = threshold
+	}
+}
+
+// Require the heartbeat timeout doc to be written with the given durability,
+// so that a heartbeat isn't lost if a Couchbase node fails before it is
+// replicated or persisted.  This adds the replication or disk latency to
+// every heartbeat, so it is off (DurabilityNone) by default.  The Store
+// must implement DurableStore.
+func WithDurability(durability Durability) Option {
+	return func(h *couchbaseHeartBeater) {
+		h.durability = durability
+	}
+}
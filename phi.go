@@ -0,0 +1,128 @@
+package cbheartbeat
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	maxPhiSamples = 100 // intervals kept per node, older ones are forgotten
+	minPhiSamples = 3   // intervals needed before phi is anything but zero
+)
+
+// Tracks the intervals between one node's heartbeats, for the phi accrual
+// failure detector (Hayashibara et al), see WithPhiAccrual.  Intervals are
+// taken from the timestamps in the node's heartbeat docs, divided by how
+// far the sequence advanced, since the checker usually only sees every few
+// heartbeats.
+type phiDetector struct {
+	intervals []float64 // seconds, oldest first
+	lastSeen  time.Time
+	sequence  uint64
+}
+
+// Record the last-seen time and sequence from the node's heartbeat doc
+func (d *phiDetector) observe(lastSeen time.Time, sequence uint64) {
+
+	if lastSeen.IsZero() || !lastSeen.After(d.lastSeen) {
+		// no new heartbeat since the last check
+		return
+	}
+	if !d.lastSeen.IsZero() {
+		interval := lastSeen.Sub(d.lastSeen).Seconds()
+		if sequence > d.sequence && d.sequence > 0 {
+			interval /= float64(sequence - d.sequence)
+		}
+		d.intervals = append(d.intervals, interval)
+		if len(d.intervals) > maxPhiSamples {
+			d.intervals = d.intervals[len(d.intervals)-maxPhiSamples:]
+		}
+	}
+	d.lastSeen = lastSeen
+	d.sequence = sequence
+
+}
+
+// How suspicious it is that there hasn't been a heartbeat since lastSeen, as
+// of now.  A phi of 1 means roughly a 10% chance of being wrong to suspect
+// the node, 2 a 1% chance, 3 a 0.1% chance and so on.
+func (d *phiDetector) phi(now time.Time) float64 {
+
+	if len(d.intervals) < minPhiSamples {
+		return 0
+	}
+
+	mean := 0.0
+	for _, interval := range d.intervals {
+		mean += interval
+	}
+	mean /= float64(len(d.intervals))
+	variance := 0.0
+	for _, interval := range d.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	variance /= float64(len(d.intervals))
+
+	// a node with perfectly regular heartbeats would otherwise be suspected
+	// the moment one is late at all
+	stdDev := math.Max(math.Sqrt(variance), mean/10)
+	if stdDev == 0 {
+		return 0
+	}
+
+	// logistic approximation of the normal distribution's tail, as used by
+	// Akka and Cassandra
+	elapsed := now.Sub(d.lastSeen).Seconds()
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+
+}
+
+// Update the node's phi detector from its heartbeat doc, and return whether
+// it is now suspected of being stale.  Always false unless running with
+// WithPhiAccrual.
+func (h *couchbaseHeartBeater) observePhi(heartbeatDoc heartbeatMeta, now time.Time) bool {
+
+	if h.phiThreshold <= 0 || heartbeatDoc.Minimal {
+		return false
+	}
+	h.phiMutex.Lock()
+	defer h.phiMutex.Unlock()
+	detector, ok := h.phiDetectors[heartbeatDoc.NodeUUID]
+	if !ok {
+		detector = &phiDetector{}
+		h.phiDetectors[heartbeatDoc.NodeUUID] = detector
+	}
+	detector.observe(heartbeatDoc.LastSeen(), heartbeatDoc.Sequence)
+	return detector.phi(now) >= h.phiThreshold
+
+}
+
+// Forget the phi detectors of nodes whose heartbeat docs are gone
+func (h *couchbaseHeartBeater) prunePhiDetectors(nodeUuids map[string]struct{}) {
+	h.phiMutex.Lock()
+	defer h.phiMutex.Unlock()
+	for nodeUuid := range h.phiDetectors {
+		if _, ok := nodeUuids[nodeUuid]; !ok {
+			delete(h.phiDetectors, nodeUuid)
+		}
+	}
+}
+
+// The phi accrual failure detector's current suspicion level for the given
+// node, as of now rather than the last check, or zero if it isn't known yet
+// or not running with WithPhiAccrual.  The node is reported stale once this
+// reaches the threshold passed to WithPhiAccrual.
+func (h *couchbaseHeartBeater) Phi(nodeUuid string) float64 {
+	h.phiMutex.Lock()
+	defer h.phiMutex.Unlock()
+	detector, ok := h.phiDetectors[nodeUuid]
+	if !ok {
+		return 0
+	}
+	return detector.phi(h.clock.Now())
+}
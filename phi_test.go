@@ -0,0 +1,58 @@
+package cbheartbeat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPhiDetector(t *testing.T) {
+
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := &phiDetector{}
+	for i := 0; i < minPhiSamples; i++ {
+		if phi := d.phi(start.Add(time.Hour)); phi != 0 {
+			t.Fatalf("phi %v after %v intervals, want 0 until there are %v", phi, i, minPhiSamples)
+		}
+		d.observe(start.Add(time.Duration(i)*time.Second), uint64(i+1))
+	}
+	d.observe(start.Add(minPhiSamples*time.Second), minPhiSamples+1)
+
+	// the same heartbeat seen again isn't another interval
+	d.observe(start.Add(minPhiSamples*time.Second), minPhiSamples+1)
+	if len(d.intervals) != minPhiSamples {
+		t.Fatalf("%v intervals, want %v", len(d.intervals), minPhiSamples)
+	}
+
+	// the suspicion grows the longer the next heartbeat is overdue
+	lastSeen := d.lastSeen
+	previous := -1.0
+	for _, elapsed := range []time.Duration{0, time.Second, 1100 * time.Millisecond, 1500 * time.Millisecond, 2 * time.Second} {
+		phi := d.phi(lastSeen.Add(elapsed))
+		if phi <= previous {
+			t.Fatalf("phi %v after %v, want more than %v", phi, elapsed, previous)
+		}
+		previous = phi
+	}
+	if phi := d.phi(lastSeen.Add(time.Second)); phi > 1 {
+		t.Fatalf("phi %v when a heartbeat is exactly on time, want less than 1", phi)
+	}
+	if phi := d.phi(lastSeen.Add(2 * time.Second)); phi < 8 {
+		t.Fatalf("phi %v when a heartbeat is a whole interval late, want at least 8", phi)
+	}
+
+}
+
+// A checker that only sees every third heartbeat still learns the node's
+// real interval
+func TestPhiDetectorSkippedHeartbeats(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := &phiDetector{}
+	for i := 0; i <= minPhiSamples; i++ {
+		d.observe(start.Add(time.Duration(3*i)*time.Second), uint64(3*i+1))
+	}
+	for _, interval := range d.intervals {
+		if interval != 1 {
+			t.Fatalf("intervals %v, want 1s each", d.intervals)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cbheartbeat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const (
+	defaultSendRetries    = 2
+	defaultSendRetryDelay = 100 * time.Millisecond
+)
+
+// Call op, retrying up to h.sendRetries more times with exponential backoff
+// as long as it keeps failing with errors that are likely to be transient.
+// Gives up waiting to retry as soon as ctx is done, eg because the sender
+// has been stopped, and returns op's last error.
+func (h *couchbaseHeartBeater) withRetry(ctx context.Context, op func() error) error {
+
+	delay := h.sendRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= h.sendRetries || !isRetryableError(err) {
+			return err
+		}
+		timer := h.clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+
+}
+
+// Is this the kind of error that might go away if we try again shortly?
+// Anything else (auth failures, missing bucket, etc) should fail fast.
+func isRetryableError(err error) bool {
+	var mcResponse *gomemcached.MCResponse
+	if errors.As(err, &mcResponse) {
+		switch mcResponse.Status {
+		case gomemcached.TMPFAIL, gomemcached.EBUSY, gomemcached.ENOMEM:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
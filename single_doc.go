@@ -0,0 +1,68 @@
+package cbheartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Whether a heartbeat doc written with WithSingleDoc has expired, going by
+// the last-seen time and timeout it carries rather than whether Couchbase has
+// got round to removing it, since expired docs linger in the view until the
+// expiry pager deletes them.  Docs which don't say when they were written are
+// taken to be alive for as long as they exist.
+func (m heartbeatMeta) expired(now time.Time) bool {
+	lastSeen := m.LastSeen()
+	if lastSeen.IsZero() || m.TimeoutMs <= 0 {
+		return false
+	}
+	return !now.Before(lastSeen.Add(time.Duration(m.TimeoutMs) * time.Millisecond))
+}
+
+// With WithSingleDoc, a stale node's heartbeat doc expires rather than being
+// left behind for the checker to find, so add the last copy seen of each
+// node's doc which has since disappeared, and return which nodes those are.
+// Only called while holding checkMutex.
+func (h *couchbaseHeartBeater) rememberSingleDocs(heartbeatDocs []heartbeatMeta) ([]heartbeatMeta, map[string]bool) {
+
+	found := map[string]bool{}
+	for _, heartbeatDoc := range heartbeatDocs {
+		if h.isSelf(heartbeatDoc.NodeUUID) || heartbeatDoc.NodeUUID == "" {
+			continue
+		}
+		found[heartbeatDoc.NodeUUID] = true
+		h.singleDocNodes[heartbeatDoc.NodeUUID] = heartbeatDoc
+	}
+
+	missing := map[string]bool{}
+	for nodeUuid, heartbeatDoc := range h.singleDocNodes {
+		if !found[nodeUuid] {
+			heartbeatDocs = append(heartbeatDocs, heartbeatDoc)
+			missing[nodeUuid] = true
+		}
+	}
+	return heartbeatDocs, missing
+
+}
+
+// The single-doc equivalent of heartbeatTimeoutDocExists
+func (h *couchbaseHeartBeater) singleDocAlive(ctx context.Context, nodeUuid string) (bool, error) {
+
+	docId := h.heartbeatDocId(nodeUuid)
+	var raw json.RawMessage
+	err := h.trace(ctx, "cbheartbeat.Get", docId, func(ctx context.Context) error {
+		return h.store.Get(docId, &raw)
+	})
+	if err != nil {
+		if err == ErrDocNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	heartbeatDoc, err := h.decodeHeartbeatDoc(raw)
+	if err != nil {
+		return false, err
+	}
+	return !heartbeatDoc.expired(h.clock.Now()), nil
+
+}
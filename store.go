@@ -0,0 +1,148 @@
+package cbheartbeat
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Returned by Store.Get and Store.Delete when the doc doesn't exist, or has expired
+var ErrDocNotFound = errors.New("cbheartbeat: doc not found")
+
+// A Store persists heartbeat docs.  The default Store is a go-couchbase
+// bucket, created by NewCouchbaseHeartbeater, but any Store can be passed to
+// NewHeartbeaterWithStore, eg a fake in tests or another Couchbase SDK.
+// Docs are passed as values which marshal to JSON.  Stores must be safe for
+// concurrent use, since the sender and checker run in separate goroutines.
+type Store interface {
+
+	// Write the doc, replacing it if it already exists.  The doc expires
+	// after ttl, or never if ttl is zero.
+	Upsert(docId string, doc interface{}, ttl time.Duration) error
+
+	// Write the doc only if it doesn't already exist, and return whether it
+	// was written.  The doc expires after ttl, or never if ttl is zero.
+	Insert(docId string, doc interface{}, ttl time.Duration) (bool, error)
+
+	// Read the doc into doc, or return ErrDocNotFound
+	Get(docId string, doc interface{}) error
+
+	// Delete the doc, or return ErrDocNotFound
+	Delete(docId string) error
+
+	// Create whatever index QueryHeartbeatDocs needs, if it doesn't already
+	// exist.  Called when the heartbeat checker starts.
+	PrepareHeartbeatQuery(heartbeatDocType string) error
+
+	// Return the JSON of every doc that has a "type" field of
+	// heartbeatDocType, which is "heartbeat" unless WithDocTypePrefix is
+	// used, and whose doc id starts with docIdPrefix.  The doc id prefix
+	// includes the key prefix, so that heartbeaters with different key
+	// prefixes sharing a bucket don't see each other's nodes.
+	QueryHeartbeatDocs(heartbeatDocType, docIdPrefix string) ([]json.RawMessage, error)
+
+	// Release any connections held by the store
+	Close() error
+}
+
+// A Store that can also read many docs in one round trip, which the checker
+// uses to look up every node's heartbeat timeout doc at once
+type BulkStore interface {
+	Store
+
+	// Return the JSON of each of the docs that exist, keyed by doc id.
+	// Docs that don't exist, or have expired, are left out.  An error means
+	// the result can't be relied on, rather than that some docs are missing.
+	GetBulk(docIds []string) (map[string]json.RawMessage, error)
+}
+
+// One of the docs written by BulkWriteStore.UpsertBulk
+type BulkWrite struct {
+	DocId string
+	Doc   interface{}
+	TTL   time.Duration // as for Store.Upsert
+}
+
+// A Store that can also write several docs in one round trip, which the
+// sender uses to write its heartbeat doc and timeout doc together.  The
+// default store doesn't implement it, since go-couchbase has no multi-op.
+type BulkWriteStore interface {
+	Store
+
+	// Same as calling Upsert for each of the writes, but without waiting
+	// for each one before starting the next.  Returns an error for each
+	// write, in the same order, which is nil if that doc was written.
+	UpsertBulk(writes []BulkWrite) []error
+}
+
+// A Store that can also reset a doc's expiry without rewriting it, which
+// the sender uses to refresh its heartbeat timeout doc when running with
+// WithMinimalWrites
+type TouchStore interface {
+	Store
+
+	// Make the doc expire after ttl from now, or return ErrDocNotFound
+	Touch(docId string, ttl time.Duration) error
+}
+
+// A Store that can also rewrite a doc only if nobody else has written it
+// since it was read, which leader election uses to renew the leader doc
+// without overwriting another node's claim
+type CasStore interface {
+	Store
+
+	// Rewrite the doc with a new ttl, but only if it currently has the same
+	// contents as doc, and return whether it was rewritten.  The doc must be
+	// read and written with compare-and-swap, so that if anyone else writes
+	// it in between, it isn't rewritten.  Returns ErrDocNotFound if the doc
+	// doesn't exist.
+	Renew(docId string, doc interface{}, ttl time.Duration) (bool, error)
+}
+
+// One row of the heartbeat view, see QueryHeartbeatView
+type HeartbeatViewRow struct {
+	Id       string          // the heartbeat doc's id
+	NodeUUID string          // empty if the doc couldn't be parsed
+	Value    json.RawMessage // the whole heartbeat doc, as emitted by the view
+}
+
+// A Store that finds heartbeat docs with a Couchbase map-reduce view, which
+// can also return the view's rows as they are, see QueryHeartbeatView
+type ViewStore interface {
+	Store
+
+	// Query the heartbeat view for the docs whose id starts with
+	// docIdPrefix.  NodeUUID is left for the caller to fill in.
+	QueryHeartbeatView(docIdPrefix string) ([]HeartbeatViewRow, error)
+}
+
+// How durable a write must be before it is considered successful.  More
+// durable writes survive more failures, at the cost of latency: every
+// heartbeat write has to wait for replication and/or a disk write.
+type Durability int
+
+const (
+	// Acknowledged once in memory on the active node.  This is the default.
+	DurabilityNone Durability = iota
+
+	// Acknowledged once on disk on the active node, without waiting for replicas
+	DurabilityPersistActive
+
+	// Acknowledged once in memory on a majority of replicas
+	DurabilityMajority
+
+	// Acknowledged once in memory on a majority of replicas and on disk on the active node
+	DurabilityMajorityAndPersistActive
+
+	// Acknowledged once on disk on a majority of replicas
+	DurabilityPersistToMajority
+)
+
+// Stores which support durable writes also implement DurableStore, and
+// must return an error for any Durability they can't provide
+type DurableStore interface {
+	Store
+
+	// Same as Upsert, but doesn't return until the write is as durable as requested
+	UpsertDurable(docId string, doc interface{}, ttl time.Duration, durability Durability) error
+}
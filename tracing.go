@@ -0,0 +1,55 @@
+package cbheartbeat
+
+import "context"
+
+// Span attribute keys
+const (
+	TraceAttrNodeUUID = "cbheartbeat.node_uuid"
+	TraceAttrDocId    = "cbheartbeat.doc_id"
+)
+
+// A Tracer starts spans around sending heartbeats, checking heartbeats and
+// each Store operation, so that heartbeat latency shows up in a tracing
+// backend.  It is an interface so that the core package doesn't depend on
+// any tracing library; the cbotel subpackage adapts an OpenTelemetry tracer.
+type Tracer interface {
+
+	// Start a span as a child of any span in ctx, and return a context that
+	// holds the new span
+	Start(ctx context.Context, spanName string, attributes map[string]string) (context.Context, Span)
+}
+
+// A Span started by a Tracer
+type Span interface {
+
+	// End the span, recording err on it if it isn't nil
+	End(err error)
+}
+
+// The default Tracer, which does nothing
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, spanName string, attributes map[string]string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(err error) {}
+
+// Run op inside a span, with this node's uuid and the doc id (if any) as
+// attributes, ending the span with whatever error op returns
+func (h *couchbaseHeartBeater) trace(ctx context.Context, spanName string, docId string, op func(ctx context.Context) error) error {
+
+	attributes := map[string]string{
+		TraceAttrNodeUUID: h.nodeUuid,
+	}
+	if docId != "" {
+		attributes[TraceAttrDocId] = docId
+	}
+	ctx, span := h.tracer.Start(ctx, spanName, attributes)
+	err := op(ctx)
+	span.End(err)
+	return err
+
+}